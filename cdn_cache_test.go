@@ -6,8 +6,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -22,6 +25,48 @@ func TestCacheFirstResponse(t *testing.T) {
 	testRequestsCachedIndefinite(t, req, nil)
 }
 
+// Should serve a cached object noticeably faster than it took to fetch from
+// a slow origin, as given by -hitLatencyRatio. This confirms that edge is
+// serving from cache, rather than revalidating with origin for every
+// request, which a matching response body alone can't show.
+func TestCacheHitFasterThanMiss(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const originDelay = 500 * time.Millisecond
+
+	originServer.ResponseDelay = originDelay
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	resp, missDuration := RoundTripTimed(t, req)
+	defer resp.Body.Close()
+
+	resp, hitDuration := RoundTripTimed(t, req)
+	defer resp.Body.Close()
+
+	t.Logf("Cache miss took %s and cache hit took %s", missDuration, hitDuration)
+
+	if missDuration < originDelay {
+		t.Fatalf("Cache miss took %s, less than origin's delay of %s", missDuration, originDelay)
+	}
+
+	maxHitDuration := time.Duration(float64(missDuration) * *hitLatencyRatio)
+	if hitDuration > maxHitDuration {
+		t.Errorf(
+			"Cache hit was too slow. Expected at most %s, got %s",
+			maxHitDuration,
+			hitDuration,
+		)
+	}
+
+	if count := originServer.RequestCountForPath(req.URL.RequestURI()); count != 1 {
+		t.Errorf("Origin received wrong number of requests. Expected 1, got %d", count)
+	}
+}
+
 // Should cache responses for the period defined in a `Expires: n` response
 // header.
 func TestCacheExpires(t *testing.T) {
@@ -38,6 +83,25 @@ func TestCacheExpires(t *testing.T) {
 	testRequestsCachedDuration(t, req, handler, cacheDuration)
 }
 
+// Should cache responses for the period defined in a `Expires: n` response
+// header when a `Cache-Control: public` header is also present. There's no
+// `max-age` to take precedence, so `Expires` must still be used for the TTL.
+func TestCacheExpiresAndPublic(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cacheDuration = time.Duration(5 * time.Second)
+
+	handler := func(w http.ResponseWriter) {
+		expiresValue := time.Now().UTC().Add(cacheDuration).Format(http.TimeFormat)
+
+		w.Header().Set("Expires", expiresValue)
+		w.Header().Set("Cache-Control", "public")
+	}
+
+	req := NewUniqueEdgeGET(t)
+	testRequestsCachedDuration(t, req, handler, cacheDuration)
+}
+
 // Should cache responses for the period defined in a `Cache-Control:
 // max-age=n` response header.
 func TestCacheCacheControlMaxAge(t *testing.T) {
@@ -54,6 +118,61 @@ func TestCacheCacheControlMaxAge(t *testing.T) {
 	testRequestsCachedDuration(t, req, handler, cacheDuration)
 }
 
+// Should cache responses for the period defined in a `Cache-Control:
+// public, max-age=n` response header.
+func TestCacheCacheControlPublicMaxAge(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cacheDuration = time.Duration(5 * time.Second)
+	headerValue := fmt.Sprintf("public, max-age=%.0f", cacheDuration.Seconds())
+
+	handler := func(w http.ResponseWriter) {
+		w.Header().Set("Cache-Control", headerValue)
+	}
+
+	req := NewUniqueEdgeGET(t)
+	testRequestsCachedDuration(t, req, handler, cacheDuration)
+}
+
+// Should cache responses for the period defined by a `Cache-Control:
+// max-age=n` response header that is sent as a separate line to `Cache-Control:
+// public`. Multiple lines of the same header are equivalent to a single
+// comma separated line, so edge shouldn't only read the first.
+func TestCacheCacheControlMultipleHeaders(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cacheDuration = time.Duration(5 * time.Second)
+	maxAgeValue := fmt.Sprintf("max-age=%.0f", cacheDuration.Seconds())
+
+	handler := func(w http.ResponseWriter) {
+		w.Header().Add("Cache-Control", "public")
+		w.Header().Add("Cache-Control", maxAgeValue)
+	}
+
+	req := NewUniqueEdgeGET(t)
+	testRequestsCachedDuration(t, req, handler, cacheDuration)
+}
+
+// Should cache responses for the period defined in a `Cache-Control:
+// s-maxage=n` response header, which shared caches use in preference to
+// `max-age=0`, even when that period is the smallest possible of one
+// second. An edge that rounds short TTLs down to zero won't cache it, and
+// one that rounds up to a minimum TTL will still serve it after it has
+// expired. Fractional values aren't valid delta-seconds so aren't tested.
+func TestCacheCacheControlSMaxAgeOneSecond(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cacheDuration = time.Duration(1 * time.Second)
+	headerValue := fmt.Sprintf("max-age=0, s-maxage=%.0f", cacheDuration.Seconds())
+
+	handler := func(w http.ResponseWriter) {
+		w.Header().Set("Cache-Control", headerValue)
+	}
+
+	req := NewUniqueEdgeGET(t)
+	testRequestsCachedDuration(t, req, handler, cacheDuration)
+}
+
 // Should cache responses for the period defined in a `Cache-Control:
 // max-age=n` response header when a `Expires: n*2` header is also present.
 func TestCacheExpiresAndMaxAge(t *testing.T) {
@@ -111,6 +230,51 @@ func TestCacheReqHeaderNoStore(t *testing.T) {
 	testRequestsCachedIndefinite(t, req, nil)
 }
 
+// Should make storage decisions according to the `Cache-Control` header of
+// the response rather than that of the request. A response with `no-store`
+// should not be cached even if the request asked for `max-age=3600`. A
+// response with `max-age=60` to a request with `no-store` should be cached
+// for other clients; TestCacheReqHeaderNoStore documents that it is also
+// served from cache to clients sending `no-store`.
+func TestCacheReqHeaderRespHeaderPrecedence(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set("Cache-Control", "max-age=3600")
+
+	testThreeRequestsNotCached(t, req, func(h http.Header) {
+		h.Set("Cache-Control", "no-store")
+	})
+
+	const expectedBody = "stored for other clients"
+
+	req = NewUniqueEdgeGET(t)
+	req.Header.Set("Cache-Control", "no-store")
+
+	resp := populateCache(t, req, expectedBody, http.Header{
+		"Cache-Control": []string{"max-age=60"},
+	})
+	defer resp.Body.Close()
+
+	otherReq := req.Clone(req.Context())
+	otherReq.Header.Del("Cache-Control")
+
+	resp = RoundTripCheckError(t, otherReq)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Request from other client received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+}
+
 // Should cache the response to a request with a `Cookie` header.
 func TestCacheHeaderCookie(t *testing.T) {
 	ResetBackends(backendsByPriority)
@@ -181,32 +345,304 @@ func TestCacheVary(t *testing.T) {
 
 	req := NewUniqueEdgeGET(t)
 
-	for _, populateCache := range []bool{true, false} {
+	t.Run("populate", func(t *testing.T) {
 		for _, headerVal := range headerVals {
-			if populateCache {
-				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			t.Run(headerVal, func(t *testing.T) {
+				req.Header.Set(reqHeaderName, headerVal)
+				resp := populateCacheWithHandler(t, req, func(w http.ResponseWriter, r *http.Request) {
 					w.Header().Set("Vary", reqHeaderName)
 					w.Header().Set(respHeaderName, r.Header.Get(reqHeaderName))
 				})
-			} else {
-				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-					t.Error("Request should not have made it to origin")
-					w.Header().Set(respHeaderName, "not cached")
+				defer resp.Body.Close()
+
+				if recVal := resp.Header.Get(respHeaderName); recVal != headerVal {
+					t.Errorf(
+						"Request received wrong %q header. Expected %q, got %q",
+						respHeaderName,
+						headerVal,
+						recVal,
+					)
+				}
+			})
+		}
+	})
+
+	// Guard against further requests to origin using the parent test,
+	// which is still running after each subtest has completed.
+	originServer.ExpectNoRequests(t)
+
+	t.Run("cached", func(t *testing.T) {
+		for _, headerVal := range headerVals {
+			t.Run(headerVal, func(t *testing.T) {
+				req.Header.Set(reqHeaderName, headerVal)
+				resp := RoundTripCheckError(t, req)
+				defer resp.Body.Close()
+
+				if recVal := resp.Header.Get(respHeaderName); recVal != headerVal {
+					t.Errorf(
+						"Request received wrong %q header. Expected %q, got %q",
+						respHeaderName,
+						headerVal,
+						recVal,
+					)
+				}
+			})
+		}
+	})
+}
+
+// Should treat the field names in a `Vary` header as case-insensitive,
+// so that `Vary: accept-encoding` from origin separates variants by the
+// client's `Accept-Encoding` header, in the same way as TestCacheVary.
+func TestCacheVaryCaseInsensitive(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const reqHeaderName = "Accept-Encoding"
+	const respHeaderName = "Reflected-" + reqHeaderName
+	varyVal := strings.ToLower(reqHeaderName)
+	headerVals := []string{
+		"gzip",
+		"somethingelse",
+	}
+
+	restoreCompression := disableClientCompression()
+	defer restoreCompression()
+
+	req := NewUniqueEdgeGET(t)
+
+	t.Run("populate", func(t *testing.T) {
+		for _, headerVal := range headerVals {
+			t.Run(headerVal, func(t *testing.T) {
+				req.Header.Set(reqHeaderName, headerVal)
+				resp := populateCacheWithHandler(t, req, func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Vary", varyVal)
+					w.Header().Set(respHeaderName, r.Header.Get(reqHeaderName))
 				})
-			}
+				defer resp.Body.Close()
 
-			req.Header.Set(reqHeaderName, headerVal)
-			resp := RoundTripCheckError(t, req)
-			defer resp.Body.Close()
+				if recVal := resp.Header.Get(respHeaderName); recVal != headerVal {
+					t.Errorf(
+						"Request received wrong %q header. Expected %q, got %q",
+						respHeaderName,
+						headerVal,
+						recVal,
+					)
+				}
+			})
+		}
+	})
 
-			if recVal := resp.Header.Get(respHeaderName); recVal != headerVal {
-				t.Errorf(
-					"Request received wrong %q header. Expected %q, got %q",
-					respHeaderName,
-					headerVal,
-					recVal,
-				)
-			}
+	originServer.ExpectNoRequests(t)
+
+	t.Run("cached", func(t *testing.T) {
+		for _, headerVal := range headerVals {
+			t.Run(headerVal, func(t *testing.T) {
+				req.Header.Set(reqHeaderName, headerVal)
+				resp := RoundTripCheckError(t, req)
+				defer resp.Body.Close()
+
+				if recVal := resp.Header.Get(respHeaderName); recVal != headerVal {
+					t.Errorf(
+						"Request received wrong %q header. Expected %q, got %q",
+						respHeaderName,
+						headerVal,
+						recVal,
+					)
+				}
+			})
+		}
+	})
+}
+
+// Should serve the same cached object to clients with different `Accept`
+// headers when origin doesn't respond with `Vary: Accept`. `Accept` must not
+// be implicitly included in the cache key, which would cause unnecessary
+// requests to origin.
+func TestCacheAcceptNotKeyedWithoutVary(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = `{"representation": "only one"}`
+	reqAccepts := []string{
+		"application/json",
+		"text/html",
+		"*/*",
+	}
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount, reqAccept := range reqAccepts {
+		req.Header.Set("Accept", reqAccept)
+
+		var resp *http.Response
+		if requestCount == 0 {
+			resp = populateCache(t, req, expectedBody, http.Header{
+				"Content-Type": []string{"application/json"},
+			})
+		} else {
+			resp = RoundTripCheckError(t, req)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request with Accept %q received incorrect response body. Expected %q, got %q",
+				reqAccept,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+
+	if count := originServer.RequestCountForPath(req.URL.RequestURI()); count != 1 {
+		t.Errorf("Origin received wrong number of requests. Expected 1, got %d", count)
+	}
+}
+
+// Should limit the number of variants of a URL that it caches when origin
+// responds with `Vary` and clients send many distinct values, to protect
+// against cache fragmentation. The limit is vendor specific and given by
+// -varyVariants. We cache one more variant than the limit and then infer
+// evictions from origin receiving requests for variants that were cached.
+func TestCacheVaryVariantsLimited(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if *varyVariants == 0 {
+		t.Skip("Edge is expected to cache an unbounded number of variants")
+	}
+
+	const reqHeaderName = "CustomThing"
+	const respHeaderName = "Reflected-" + reqHeaderName
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", reqHeaderName)
+		w.Header().Set(respHeaderName, r.Header.Get(reqHeaderName))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	variants := *varyVariants + 1
+
+	for variant := 1; variant <= variants; variant++ {
+		req.Header.Set(reqHeaderName, fmt.Sprintf("variant %d", variant))
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+	}
+
+	requestsBefore := originServer.RequestCountForPath(req.URL.RequestURI())
+
+	// Most recent first, so that re-fetching evicted variants doesn't in
+	// turn evict the variants that we haven't checked yet.
+	for variant := variants; variant >= 1; variant-- {
+		headerVal := fmt.Sprintf("variant %d", variant)
+		req.Header.Set(reqHeaderName, headerVal)
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if recVal := resp.Header.Get(respHeaderName); recVal != headerVal {
+			t.Errorf(
+				"Request received wrong %q header. Expected %q, got %q",
+				respHeaderName,
+				headerVal,
+				recVal,
+			)
+		}
+	}
+
+	evictions := originServer.RequestCountForPath(req.URL.RequestURI()) - requestsBefore
+	if evictions == 0 {
+		t.Errorf(
+			"Edge cached all %d variants. Expected at most %d",
+			variants,
+			*varyVariants,
+		)
+	}
+}
+
+// Should cache distinct responses for each `Accept-Language` when origin
+// responds with `Vary: Accept-Language`, including values with quality
+// factors. Whether edge normalises differently cased or reordered values
+// into the same cache key is reported but not asserted, because RFC 7231
+// leaves it to the cache.
+func TestCacheVaryAcceptLanguage(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if vendorCloudflare {
+		t.Skip(notSupportedByVendor)
+	}
+
+	const reqHeaderName = "Accept-Language"
+	const respHeaderName = "Reflected-" + reqHeaderName
+	headerVals := []string{
+		"en-GB",
+		"fr",
+		"en;q=0.8, fr",
+	}
+	equivalentHeaderVals := map[string]string{
+		"en-gb":       "en-GB",
+		"en;q=0.8,fr": "en;q=0.8, fr",
+	}
+
+	req := NewUniqueEdgeGET(t)
+
+	for _, headerVal := range headerVals {
+		req.Header.Set(reqHeaderName, headerVal)
+		resp := populateCacheWithHandler(t, req, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Vary", reqHeaderName)
+			w.Header().Set(respHeaderName, r.Header.Get(reqHeaderName))
+		})
+		defer resp.Body.Close()
+
+		if recVal := resp.Header.Get(respHeaderName); recVal != headerVal {
+			t.Errorf(
+				"Request received wrong %q header. Expected %q, got %q",
+				respHeaderName,
+				headerVal,
+				recVal,
+			)
+		}
+	}
+
+	for _, headerVal := range headerVals {
+		req.Header.Set(reqHeaderName, headerVal)
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if recVal := resp.Header.Get(respHeaderName); recVal != headerVal {
+			t.Errorf(
+				"Request received wrong %q header. Expected %q, got %q",
+				respHeaderName,
+				headerVal,
+				recVal,
+			)
+		}
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", reqHeaderName)
+		w.Header().Set(respHeaderName, r.Header.Get(reqHeaderName))
+	})
+
+	for headerVal, cachedVal := range equivalentHeaderVals {
+		req.Header.Set(reqHeaderName, headerVal)
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		switch recVal := resp.Header.Get(respHeaderName); recVal {
+		case cachedVal:
+			t.Logf("Edge normalised %q to the cache entry for %q", headerVal, cachedVal)
+		case headerVal:
+			t.Logf("Edge cached %q separately from %q", headerVal, cachedVal)
+		default:
+			t.Errorf(
+				"Request received wrong %q header. Expected %q or %q, got %q",
+				respHeaderName,
+				headerVal,
+				cachedVal,
+				recVal,
+			)
 		}
 	}
 }
@@ -221,94 +657,99 @@ func TestCacheAcceptEncodingGzip(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
 	const expectedBody = "may or may not be gzipped"
-	var reqAcceptEncoding string
-	var expectedContentEncoding string
 
-	// Tell the transport not to add Accept-Encoding headers and automatically
-	// decompress responses. Restore the setting after the test.
-	origClientDisableCompression := client.DisableCompression
-	client.DisableCompression = true
-	defer func() {
-		client.DisableCompression = origClientDisableCompression
-	}()
+	restoreCompression := disableClientCompression()
+	defer restoreCompression()
 
 	req := NewUniqueEdgeGET(t)
 
 	for _, populateCache := range []bool{true, false} {
-		for _, gzipContent := range []bool{false, true} {
-			if gzipContent {
-				reqAcceptEncoding = "gzip"
-				expectedContentEncoding = "gzip"
-			} else {
-				reqAcceptEncoding = "somethingelse"
-				expectedContentEncoding = ""
-			}
-
-			if populateCache {
-				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-					// NB: Some vendors don't appear to depend on this.
-					w.Header().Set("Vary", "Accept-Encoding")
+		phase := "cached"
+		if populateCache {
+			phase = "populate"
+		}
 
-					// Don't switch on `gzipContent` because the edge may ask for gzip
-					// even if the client hasn't.
-					if r.Header.Get("Accept-Encoding") == "gzip" {
-						gzbuf := new(bytes.Buffer)
-						gzwriter := gzip.NewWriter(gzbuf)
-						gzwriter.Write([]byte(expectedBody))
-						gzwriter.Close()
+		if !populateCache {
+			// Use the parent test, as in TestCacheVary.
+			originServer.ExpectNoRequests(t)
+		}
 
-						w.Header().Set("Content-Encoding", "gzip")
-						w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		t.Run(phase, func(t *testing.T) {
+			for _, gzipContent := range []bool{false, true} {
+				var reqAcceptEncoding string
+				var expectedContentEncoding string
+
+				if gzipContent {
+					reqAcceptEncoding = "gzip"
+					expectedContentEncoding = "gzip"
+				} else {
+					reqAcceptEncoding = "somethingelse"
+					expectedContentEncoding = ""
+				}
 
-						w.Write(gzbuf.Bytes())
-					} else {
-						w.Write([]byte(expectedBody))
+				t.Run(reqAcceptEncoding, func(t *testing.T) {
+					if populateCache {
+						originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+							// NB: Some vendors don't appear to depend on this.
+							w.Header().Set("Vary", "Accept-Encoding")
+
+							// Don't switch on `gzipContent` because the edge may ask for gzip
+							// even if the client hasn't.
+							if r.Header.Get("Accept-Encoding") == "gzip" {
+								gzbuf := new(bytes.Buffer)
+								gzwriter := gzip.NewWriter(gzbuf)
+								gzwriter.Write([]byte(expectedBody))
+								gzwriter.Close()
+
+								w.Header().Set("Content-Encoding", "gzip")
+								w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+								w.Write(gzbuf.Bytes())
+							} else {
+								w.Write([]byte(expectedBody))
+							}
+						})
 					}
-				})
-			} else {
-				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-					t.Error("Request should not have made it to origin")
-					w.Write([]byte("uncached response"))
-				})
-			}
 
-			req.Header.Set("Accept-Encoding", reqAcceptEncoding)
-			resp := RoundTripCheckError(t, req)
-			defer resp.Body.Close()
+					req.Header.Set("Accept-Encoding", reqAcceptEncoding)
+					resp := RoundTripCheckError(t, req)
+					defer resp.Body.Close()
 
-			if headerVal := resp.Header.Get("Content-Encoding"); headerVal != expectedContentEncoding {
-				t.Fatalf(
-					"Request received incorrect Content-Encoding header. Expected %q, got %q",
-					expectedContentEncoding,
-					headerVal,
-				)
-			}
+					if headerVal := resp.Header.Get("Content-Encoding"); headerVal != expectedContentEncoding {
+						t.Fatalf(
+							"Request received incorrect Content-Encoding header. Expected %q, got %q",
+							expectedContentEncoding,
+							headerVal,
+						)
+					}
 
-			var rawBody io.ReadCloser
-			if gzipContent {
-				var err error
-				rawBody, err = gzip.NewReader(resp.Body)
-				if err != nil {
-					t.Fatal(err)
-				}
-				defer rawBody.Close()
-			} else {
-				rawBody = resp.Body
-			}
+					var rawBody io.ReadCloser
+					if gzipContent {
+						var err error
+						rawBody, err = gzip.NewReader(resp.Body)
+						if err != nil {
+							t.Fatal(err)
+						}
+						defer rawBody.Close()
+					} else {
+						rawBody = resp.Body
+					}
 
-			body, err := ioutil.ReadAll(rawBody)
-			if err != nil {
-				t.Fatal(err)
-			}
+					body, err := ioutil.ReadAll(rawBody)
+					if err != nil {
+						t.Fatal(err)
+					}
 
-			if bodyStr := string(body); bodyStr != expectedBody {
-				t.Errorf(
-					"Request received incorrect response body. Expected %q, got %q",
-					expectedBody,
-					bodyStr,
-				)
+					if bodyStr := string(body); bodyStr != expectedBody {
+						t.Errorf(
+							"Request received incorrect response body. Expected %q, got %q",
+							expectedBody,
+							bodyStr,
+						)
+					}
+				})
 			}
-		}
+		})
 	}
 }
 
@@ -337,34 +778,52 @@ func TestCacheUniqueQueryParams(t *testing.T) {
 		)
 	}
 
-	for _, populateCache := range []bool{true, false} {
-		for _, req := range []*http.Request{req1, req2} {
-			if populateCache {
-				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	reqs := map[string]*http.Request{
+		"first":  req1,
+		"second": req2,
+	}
+
+	t.Run("populate", func(t *testing.T) {
+		for _, name := range []string{"first", "second"} {
+			req := reqs[name]
+			t.Run(name, func(t *testing.T) {
+				resp := populateCacheWithHandler(t, req, func(w http.ResponseWriter, r *http.Request) {
 					w.Header().Set(respHeaderName, r.URL.RawQuery)
 				})
-			} else {
-				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				defer resp.Body.Close()
+
+				if recVal := resp.Header.Get(respHeaderName); recVal != req.URL.RawQuery {
 					t.Errorf(
-						"Request with query param %q should not have made it to origin",
-						r.URL.RawQuery,
+						"Request received wrong %q header. Expected %q, got %q",
+						respHeaderName,
+						req.URL.RawQuery,
+						recVal,
 					)
-				})
-			}
+				}
+			})
+		}
+	})
 
-			resp := RoundTripCheckError(t, req)
-			defer resp.Body.Close()
+	originServer.ExpectNoRequests(t)
 
-			if recVal := resp.Header.Get(respHeaderName); recVal != req.URL.RawQuery {
-				t.Errorf(
-					"Request received wrong %q header. Expected %q, got %q",
-					respHeaderName,
-					req.URL.RawQuery,
-					recVal,
-				)
-			}
+	t.Run("cached", func(t *testing.T) {
+		for _, name := range []string{"first", "second"} {
+			req := reqs[name]
+			t.Run(name, func(t *testing.T) {
+				resp := RoundTripCheckError(t, req)
+				defer resp.Body.Close()
+
+				if recVal := resp.Header.Get(respHeaderName); recVal != req.URL.RawQuery {
+					t.Errorf(
+						"Request received wrong %q header. Expected %q, got %q",
+						respHeaderName,
+						req.URL.RawQuery,
+						recVal,
+					)
+				}
+			})
 		}
-	}
+	})
 }
 
 // Should cache distinct responses for requests with the same query params
@@ -397,32 +856,1647 @@ func TestCacheUniqueCaseSensitive(t *testing.T) {
 		)
 	}
 
-	for _, populateCache := range []bool{true, false} {
-		for _, req := range []*http.Request{req1, req2} {
-			if populateCache {
-				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-					w.Header().Set(respHeaderName, r.URL.Path)
-				})
-			} else {
-				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-					t.Errorf(
-						"Request with path %q should not have made it to origin",
-						r.URL.Path,
-					)
-				})
-			}
+	for _, req := range []*http.Request{req1, req2} {
+		resp := populateCache(t, req, "", http.Header{
+			respHeaderName: []string{req.URL.Path},
+		})
+		defer resp.Body.Close()
+	}
 
-			resp := RoundTripCheckError(t, req)
-			defer resp.Body.Close()
+	for _, req := range []*http.Request{req1, req2} {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if recVal := resp.Header.Get(respHeaderName); recVal != req.URL.Path {
+			t.Errorf(
+				"Request received wrong %q header. Expected %q, got %q",
+				respHeaderName,
+				req.URL.Path,
+				recVal,
+			)
+		}
+	}
+}
 
-			if recVal := resp.Header.Get(respHeaderName); recVal != req.URL.Path {
-				t.Errorf(
-					"Request received wrong %q header. Expected %q, got %q",
-					respHeaderName,
-					req.URL.Path,
-					recVal,
-				)
+// Should create separate cache entries for paths that only become the same
+// after percent-decoding a reserved character, such as `/a%2Fb` and `/a/b`.
+// RFC 3986 doesn't consider these equivalent, because an encoded `/` isn't a
+// path separator, so origin may serve different content for each.
+func TestCacheUniqueEncodedReservedChars(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const decodedPath = "/a/b"
+	const encodedPath = "/a%2Fb"
+
+	req1 := NewUniqueEdgeGET(t)
+	req2 := NewUniqueEdgeGET(t)
+
+	req1.URL.Path = decodedPath
+	req2.URL.Path = decodedPath
+	req2.URL.RawPath = encodedPath
+	req2.URL.RawQuery = req1.URL.RawQuery
+
+	if reqURI := req2.URL.RequestURI(); !strings.HasPrefix(reqURI, encodedPath) {
+		t.Fatalf(
+			"Request path is not encoded. Expected %q, got %q",
+			encodedPath,
+			reqURI,
+		)
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte(r.URL.RequestURI()))
+	})
+
+	for requestCount := 1; requestCount <= 2; requestCount++ {
+		for _, req := range []*http.Request{req1, req2} {
+			expectedBody := req.URL.RequestURI()
+
+			resp := RoundTripCheckError(t, req)
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bodyStr := string(body); bodyStr != expectedBody {
+				t.Errorf(
+					"Request %d received incorrect response body. Expected %q, got %q",
+					requestCount,
+					expectedBody,
+					bodyStr,
+				)
+			}
+		}
+	}
+
+	for _, req := range []*http.Request{req1, req2} {
+		reqURI := req.URL.RequestURI()
+		if count := originServer.RequestCountForPath(reqURI); count != 1 {
+			t.Errorf(
+				"Origin received wrong number of requests for %q. Expected 1, got %d",
+				reqURI,
+				count,
+			)
+		}
+	}
+}
+
+// Should handle repeated slashes in a request path consistently, both when
+// forwarding the request to origin and when keying the cache. The
+// -slashPolicy flag selects whether edge is expected to pass paths through
+// as they are ("preserve"), so `/foo//bar` and `/foo/bar` are separate
+// objects, or to collapse the slashes ("collapse"), so that they're the same
+// object and origin only ever sees `/foo/bar`.
+func TestCacheRepeatedSlashes(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const singleSlashPath = "/foo/bar"
+	const doubleSlashPath = "/foo//bar"
+
+	req1 := NewUniqueEdgeGET(t)
+	req2 := NewUniqueEdgeGET(t)
+
+	req1.URL.Path = singleSlashPath
+	req2.URL.Path = doubleSlashPath
+	req2.URL.RawQuery = req1.URL.RawQuery
+
+	var expectedBodies, expectedForwardedURLs []string
+	switch *slashPolicy {
+	case "preserve":
+		expectedBodies = []string{req1.URL.RequestURI(), req2.URL.RequestURI()}
+		expectedForwardedURLs = expectedBodies
+	case "collapse":
+		expectedBodies = []string{req1.URL.RequestURI(), req1.URL.RequestURI()}
+		expectedForwardedURLs = expectedBodies[:1]
+	default:
+		t.Fatalf("Slash policy %q unrecognised", *slashPolicy)
+	}
+
+	originServer.Record = true
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte(r.URL.RequestURI()))
+	})
+
+	for requestCount, req := range []*http.Request{req1, req2} {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBodies[requestCount] {
+			t.Errorf(
+				"Request %d for %q received incorrect response body. Expected %q, got %q",
+				requestCount+1,
+				req.URL.Path,
+				expectedBodies[requestCount],
+				bodyStr,
+			)
+		}
+	}
+
+	var forwardedURLs []string
+	for _, exchange := range originServer.Transcript() {
+		forwardedURLs = append(forwardedURLs, exchange.URL)
+	}
+
+	if !reflect.DeepEqual(forwardedURLs, expectedForwardedURLs) {
+		t.Errorf(
+			"Origin received incorrect requests. Expected %q, got %q",
+			expectedForwardedURLs,
+			forwardedURLs,
+		)
+	}
+}
+
+// Should serve a `HEAD` request for a cached object from cache, with the
+// same headers as the cached `GET` response and no body. Origin will never
+// see the request because CDNBackendServer swallows `HEAD` requests as
+// health checks, so we must prove that the response came from the edge.
+func TestCacheHEADFromCache(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "cached response body"
+	const expectedContentType = "text/plain; charset=utf-8"
+	headerNames := []string{"Content-Length", "Content-Type"}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", expectedContentType)
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Request to populate cache received incorrect status %q", resp.Status)
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Request should not have made it to origin")
+	})
+
+	req.Method = "HEAD"
+	headResp := RoundTripCheckError(t, req)
+	defer headResp.Body.Close()
+
+	if headResp.StatusCode != http.StatusOK {
+		t.Errorf(
+			"HEAD request received incorrect status code. Expected %d, got %d",
+			http.StatusOK,
+			headResp.StatusCode,
+		)
+	}
+
+	for _, headerName := range headerNames {
+		expectedVal := resp.Header.Get(headerName)
+		if receivedVal := headResp.Header.Get(headerName); receivedVal != expectedVal {
+			t.Errorf(
+				"HEAD request received incorrect %q header. Expected %q, got %q",
+				headerName,
+				expectedVal,
+				receivedVal,
+			)
+		}
+	}
+
+	body, err := ioutil.ReadAll(headResp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) != 0 {
+		t.Errorf("HEAD request received non-empty response body %q", body)
+	}
+}
+
+// Should serve a partial `206` response to a `Range` request with an
+// `If-Range` header that matches the `ETag` of the cached object, and a full
+// `200` response once the object has been replaced by one with a different
+// `ETag`.
+func TestCacheRangeIfRange(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cacheDuration = time.Duration(2 * time.Second)
+	const cacheDurationWithBuffer = cacheDuration * 2
+	const rangeHeaderVal = "bytes=0-99"
+	const rangeLength = 100
+	const originalETag = `"original"`
+	const changedETag = `"changed"`
+
+	originalBody := strings.Repeat("o", rangeLength*2)
+	changedBody := strings.Repeat("c", rangeLength*2)
+	cacheControlValue := fmt.Sprintf("max-age=%.0f", cacheDuration.Seconds())
+
+	originHandler := func(etag, body string) func(w http.ResponseWriter, r *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", cacheControlValue)
+			w.Header().Set("ETag", etag)
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+		}
+	}
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount < 4; requestCount++ {
+		var expectedStatus int
+		var expectedBody string
+
+		switch requestCount {
+		case 1: // Request 1 populates cache.
+			originServer.SwitchHandler(originHandler(originalETag, originalBody))
+			expectedStatus = http.StatusOK
+			expectedBody = originalBody
+		case 2: // Request 2 matches the cached ETag and gets a range from cache.
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Request should not have made it to origin")
+			})
+			req.Header.Set("Range", rangeHeaderVal)
+			req.Header.Set("If-Range", originalETag)
+			expectedStatus = http.StatusPartialContent
+			expectedBody = originalBody[:rangeLength]
+		case 3: // Request 3 no longer matches the replaced ETag.
+			time.Sleep(cacheDurationWithBuffer)
+			originServer.SwitchHandler(originHandler(changedETag, changedBody))
+			expectedStatus = http.StatusOK
+			expectedBody = changedBody
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Errorf(
+				"Request %d received incorrect status code. Expected %d, got %d",
+				requestCount,
+				expectedStatus,
+				resp.StatusCode,
+			)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
+// Should serve the same cacheable response, with the same headers, to
+// clients connecting over IPv4 and IPv6, and then serve both from cache.
+// Only one address family will be tested if the other isn't reachable.
+func TestCacheAddressFamilyParity(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "same for all address families"
+	headerNames := []string{"Cache-Control", "Content-Length", "Content-Type"}
+
+	req := NewUniqueEdgeGET(t)
+
+	for _, populateCache := range []bool{true, false} {
+		if populateCache {
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=1800, public")
+				w.Write([]byte(expectedBody))
+			})
+		} else {
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Request should not have made it to origin")
+				w.Write([]byte("not cached"))
+			})
+		}
+
+		ipv4Resp, ipv6Resp := RoundTripBothFamilies(t, req)
+		familyResponses := map[string]*http.Response{
+			"IPv4": ipv4Resp,
+			"IPv6": ipv6Resp,
+		}
+
+		for family, resp := range familyResponses {
+			if resp == nil {
+				continue
+			}
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bodyStr := string(body); bodyStr != expectedBody {
+				t.Errorf(
+					"Request over %s received incorrect response body. Expected %q, got %q",
+					family,
+					expectedBody,
+					bodyStr,
+				)
+			}
+		}
+
+		if ipv4Resp == nil || ipv6Resp == nil {
+			continue
+		}
+
+		if ipv4Resp.StatusCode != ipv6Resp.StatusCode {
+			t.Errorf(
+				"Requests received different status codes. IPv4 got %d, IPv6 got %d",
+				ipv4Resp.StatusCode,
+				ipv6Resp.StatusCode,
+			)
+		}
+
+		for _, headerName := range headerNames {
+			ipv4Val := ipv4Resp.Header.Get(headerName)
+			ipv6Val := ipv6Resp.Header.Get(headerName)
+			if ipv4Val != ipv6Val {
+				t.Errorf(
+					"Requests received different %q headers. IPv4 got %q, IPv6 got %q",
+					headerName,
+					ipv4Val,
+					ipv6Val,
+				)
+			}
+		}
+	}
+}
+
+// Should merge the headers of a cached object with those of a `304 Not
+// Modified` response from origin when revalidating an expired object, so
+// that the client still receives the original `Content-Type` and custom
+// headers, which aren't present in the `304`. Skips if edge refetches the
+// object without a conditional request, because there's nothing to merge.
+func TestCacheRevalidate304PreservesHeaders(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cacheDuration = time.Duration(2 * time.Second)
+	const cacheDurationWithBuffer = cacheDuration * 2
+	const etag = `"unchanged"`
+	const expectedBody = "revalidated response"
+	const expectedContentType = "application/x-cdn-acceptance-tests"
+	const customHeaderName = "Custom-Header"
+	const customHeaderVal = "survives revalidation"
+
+	expectedHeaders := map[string]string{
+		"Content-Type":   expectedContentType,
+		customHeaderName: customHeaderVal,
+		"ETag":           etag,
+	}
+	cacheControlValue := fmt.Sprintf("max-age=%.0f", cacheDuration.Seconds())
+
+	originServer.Record = true
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Cache-Control", cacheControlValue)
+		w.Header().Set("Content-Type", expectedContentType)
+		w.Header().Set(customHeaderName, customHeaderVal)
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount < 3; requestCount++ {
+		if requestCount == 2 {
+			time.Sleep(cacheDurationWithBuffer)
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Request %d received incorrect status %q", requestCount, resp.Status)
+		}
+
+		for headerName, expectedVal := range expectedHeaders {
+			if receivedVal := resp.Header.Get(headerName); receivedVal != expectedVal {
+				t.Errorf(
+					"Request %d received incorrect %q header. Expected %q, got %q",
+					requestCount,
+					headerName,
+					expectedVal,
+					receivedVal,
+				)
+			}
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+
+	receivedConditional := false
+	for _, exchange := range originServer.Transcript() {
+		if exchange.StatusCode == http.StatusNotModified {
+			receivedConditional = true
+		}
+	}
+	if !receivedConditional {
+		t.Skip("Origin didn't receive a conditional request, so no 304 was merged")
+	}
+}
+
+// Should not serve a gzip compressed response from cache to a client that
+// doesn't accept gzip, even if origin didn't send `Vary: Accept-Encoding`.
+// Fastly relies on origin to provide the `Vary` header, which is tested by
+// TestCacheAcceptEncodingGzip.
+func TestCacheAcceptEncodingWithoutVary(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if vendorFastly {
+		t.Skip(notSupportedByVendor)
+	}
+
+	const expectedBody = "should only be gzipped if asked for"
+
+	restoreCompression := disableClientCompression()
+	defer restoreCompression()
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			gzbuf := new(bytes.Buffer)
+			gzwriter := gzip.NewWriter(gzbuf)
+			gzwriter.Write([]byte(expectedBody))
+			gzwriter.Close()
+
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+			w.Write(gzbuf.Bytes())
+		} else {
+			w.Write([]byte(expectedBody))
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	// First request populates cache with a gzipped response.
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	// Second request must not be given the gzipped response.
+	req.Header.Set("Accept-Encoding", "somethingelse")
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if headerVal := resp.Header.Get("Content-Encoding"); headerVal != "" {
+		t.Errorf("Request received Content-Encoding header %q that it didn't accept", headerVal)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Request received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+}
+
+// Should normalise `Accept-Encoding` headers that are cosmetically
+// different but all accept gzip, so that they share a single cached
+// variant and origin only receives one request.
+func TestCacheAcceptEncodingNormalised(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "one variant for all"
+	const expectedContentEncoding = "gzip"
+	reqAcceptEncodings := []string{
+		"gzip",
+		"gzip, deflate",
+		"deflate, gzip",
+		"gzip, deflate, br;q=0.9",
+		"gzip;q=1.0",
+	}
+
+	restoreCompression := disableClientCompression()
+	defer restoreCompression()
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Encoding")
+
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			gzbuf := new(bytes.Buffer)
+			gzwriter := gzip.NewWriter(gzbuf)
+			gzwriter.Write([]byte(expectedBody))
+			gzwriter.Close()
+
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+			w.Write(gzbuf.Bytes())
+		} else {
+			w.Write([]byte(expectedBody))
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for _, reqAcceptEncoding := range reqAcceptEncodings {
+		req.Header.Set("Accept-Encoding", reqAcceptEncoding)
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if headerVal := resp.Header.Get("Content-Encoding"); headerVal != expectedContentEncoding {
+			t.Errorf(
+				"Request with Accept-Encoding %q received incorrect Content-Encoding header. Expected %q, got %q",
+				reqAcceptEncoding,
+				expectedContentEncoding,
+				headerVal,
+			)
+		}
+
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count := originServer.RequestCountForPath(req.URL.RequestURI()); count != 1 {
+		t.Errorf("Origin received wrong number of requests. Expected 1, got %d", count)
+	}
+}
+
+// Should serve an uncompressed response, without a `Content-Encoding`
+// header, to a client that explicitly sends `Accept-Encoding: identity`,
+// even when a gzip compressed variant of the same object is already cached.
+func TestCacheAcceptEncodingIdentity(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "not compressed for you"
+
+	restoreCompression := disableClientCompression()
+	defer restoreCompression()
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Vary", "Accept-Encoding")
+
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			gzbuf := new(bytes.Buffer)
+			gzwriter := gzip.NewWriter(gzbuf)
+			gzwriter.Write([]byte(expectedBody))
+			gzwriter.Close()
+
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+			w.Write(gzbuf.Bytes())
+		} else {
+			w.Write([]byte(expectedBody))
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if headerVal := resp.Header.Get("Content-Encoding"); headerVal != "gzip" {
+		t.Fatalf(
+			"Request with Accept-Encoding gzip received incorrect Content-Encoding header. Expected %q, got %q",
+			"gzip",
+			headerVal,
+		)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if headerVal := resp.Header.Get("Content-Encoding"); headerVal != "" {
+		t.Errorf(
+			"Request with Accept-Encoding identity received incorrect Content-Encoding header. Expected %q, got %q",
+			"",
+			headerVal,
+		)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Request with Accept-Encoding identity received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+}
+
+// Should serve the same cached object for requests whose `Host` headers
+// differ only by case, because hostnames are case-insensitive. The
+// connection is still made to edgeHost, so only the header differs. Can't
+// be tested if edgeHost is an IP address.
+func TestCacheHostCaseInsensitive(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if net.ParseIP(*edgeHost) != nil {
+		t.Skip("edgeHost is an IP address, which has no case")
+	}
+
+	const expectedBody = "same object for any case"
+	reqHosts := []string{
+		strings.ToLower(*edgeHost),
+		strings.ToUpper(*edgeHost),
+		strings.ToUpper((*edgeHost)[:1]) + strings.ToLower((*edgeHost)[1:]),
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount, reqHost := range reqHosts {
+		req.Host = reqHost
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d with Host %q received incorrect response body. Expected %q, got %q",
+				requestCount+1,
+				reqHost,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+
+	if count := originServer.RequestCountForPath(req.URL.RequestURI()); count != 1 {
+		t.Errorf("Origin received wrong number of requests. Expected 1, got %d", count)
+	}
+}
+
+// Should use weak comparison for `If-None-Match`, so that a cached object
+// with a weak `ETag` matches either form of the same tag and gets a `304`,
+// but should never accept a weak validator for `If-Range`, so that a range
+// request gets the full `200` response. See RFC 7232 section 2.3.2:
+// http://tools.ietf.org/html/rfc7232#section-2.3.2
+func TestCacheWeakETag(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const weakETag = `W/"weak"`
+	const strongETag = `"weak"`
+	const rangeHeaderVal = "bytes=0-99"
+
+	expectedBody := strings.Repeat("w", 200)
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+		w.Header().Set("ETag", weakETag)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount < 5; requestCount++ {
+		var expectedStatus int
+
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Range")
+		req.Header.Del("Range")
+
+		switch requestCount {
+		case 1: // Request 1 populates cache.
+			expectedStatus = http.StatusOK
+		case 2: // Request 2 matches the weak ETag.
+			originServer.ExpectNoRequests(t)
+			req.Header.Set("If-None-Match", weakETag)
+			expectedStatus = http.StatusNotModified
+		case 3: // Request 3 matches the weak ETag by weak comparison.
+			req.Header.Set("If-None-Match", strongETag)
+			expectedStatus = http.StatusNotModified
+		case 4: // Request 4 can't use a weak ETag for a range.
+			req.Header.Set("Range", rangeHeaderVal)
+			req.Header.Set("If-Range", weakETag)
+			expectedStatus = http.StatusOK
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Errorf(
+				"Request %d received incorrect status code. Expected %d, got %d",
+				requestCount,
+				expectedStatus,
+				resp.StatusCode,
+			)
+		}
+
+		if expectedStatus != http.StatusOK {
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
+// Should serve a correct `Content-Length`, matching the length of the body,
+// for both cache MISS and HIT responses. When origin doesn't provide a
+// `Content-Length` and uses chunked encoding, the edge may either add a
+// correct one or continue to use chunked encoding, but should do the same
+// for both the MISS and the HIT.
+func TestCacheContentLength(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	expectedBody := strings.Repeat("content length ", 256)
+
+	for _, originChunked := range []bool{false, true} {
+		originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			if originChunked {
+				// Flushing before the body is complete forces chunked encoding.
+				w.Write([]byte(expectedBody[:1]))
+				w.(http.Flusher).Flush()
+				w.Write([]byte(expectedBody[1:]))
+			} else {
+				w.Header().Set("Content-Length", fmt.Sprintf("%d", len(expectedBody)))
+				w.Write([]byte(expectedBody))
+			}
+		})
+
+		req := NewUniqueEdgeGET(t)
+
+		var missContentLength int64
+		var missTransferEncoding []string
+
+		for requestCount := 1; requestCount < 3; requestCount++ {
+			if requestCount == 2 {
+				originServer.ExpectNoRequests(t)
+			}
+
+			resp := RoundTripCheckError(t, req)
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bodyStr := string(body); bodyStr != expectedBody {
+				t.Errorf(
+					"Request %d (origin chunked %t) received incorrect response body. Expected %d bytes, got %d",
+					requestCount,
+					originChunked,
+					len(expectedBody),
+					len(body),
+				)
+			}
+
+			// ContentLength is -1 when the response is chunked.
+			if resp.ContentLength != -1 && resp.ContentLength != int64(len(body)) {
+				t.Errorf(
+					"Request %d (origin chunked %t) received incorrect Content-Length. Expected %d, got %d",
+					requestCount,
+					originChunked,
+					len(body),
+					resp.ContentLength,
+				)
+			}
+			if !originChunked && resp.ContentLength == -1 {
+				t.Errorf("Request %d received no Content-Length, although origin provided one", requestCount)
+			}
+
+			// Whichever framing edge chooses for a chunked response from
+			// origin, it should use the same for the MISS and the HIT.
+			if requestCount == 1 {
+				missContentLength = resp.ContentLength
+				missTransferEncoding = resp.TransferEncoding
+			} else if originChunked {
+				if resp.ContentLength != missContentLength {
+					t.Errorf(
+						"Request %d received Content-Length inconsistent with cache MISS. Expected %d, got %d",
+						requestCount,
+						missContentLength,
+						resp.ContentLength,
+					)
+				}
+				if !reflect.DeepEqual(resp.TransferEncoding, missTransferEncoding) {
+					t.Errorf(
+						"Request %d received Transfer-Encoding inconsistent with cache MISS. Expected %q, got %q",
+						requestCount,
+						missTransferEncoding,
+						resp.TransferEncoding,
+					)
+				}
+			}
+		}
+	}
+}
+
+// Should cache and serve responses that have no body, both a 200 with a
+// `Content-Length: 0` header and a 204, without waiting for a body that
+// will never arrive or adding content of its own.
+func TestCacheZeroLengthBody(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	for _, expectedStatus := range []int{http.StatusOK, http.StatusNoContent} {
+		originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=3600")
+			if expectedStatus == http.StatusOK {
+				w.Header().Set("Content-Length", "0")
+			}
+			w.WriteHeader(expectedStatus)
+		})
+
+		req := NewUniqueEdgeGET(t)
+
+		for requestCount := 1; requestCount < 3; requestCount++ {
+			resp := RoundTripCheckError(t, req)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != expectedStatus {
+				t.Errorf(
+					"Request %d (status %d) received incorrect status code. Expected %d, got %d",
+					requestCount,
+					expectedStatus,
+					expectedStatus,
+					resp.StatusCode,
+				)
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(body) != 0 {
+				t.Errorf(
+					"Request %d (status %d) received incorrect response body. Expected 0 bytes, got %q",
+					requestCount,
+					expectedStatus,
+					string(body),
+				)
+			}
+
+			if expectedStatus == http.StatusOK && resp.ContentLength != 0 {
+				t.Errorf(
+					"Request %d (status %d) received incorrect Content-Length. Expected 0, got %d",
+					requestCount,
+					expectedStatus,
+					resp.ContentLength,
+				)
+			}
+		}
+
+		if count := originServer.RequestCountForPath(req.URL.RequestURI()); count != 1 {
+			t.Errorf(
+				"Origin received wrong number of requests for status %d. Expected 1, got %d",
+				expectedStatus,
+				count,
+			)
+		}
+	}
+}
+
+// Should continue to serve a cached object for its full TTL after origin
+// changes to responding with `Cache-Control: no-store`, as might happen
+// during a deploy, and only honour `no-store` once the object has expired.
+func TestCacheOriginBecomesUncacheable(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cacheDuration = time.Duration(5 * time.Second)
+	const cacheDurationWithBuffer = cacheDuration + (cacheDuration / 4)
+	const expectedResponseCached = "cached before deploy"
+	const expectedResponseUncached = "uncacheable after deploy"
+	cacheControlValue := fmt.Sprintf("max-age=%.0f", cacheDuration.Seconds())
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount < 5; requestCount++ {
+		var expectedBody string
+		var expectedOriginRequests int
+
+		switch requestCount {
+		case 1: // Request 1 populates cache.
+			expectedBody = expectedResponseCached
+			expectedOriginRequests = 1
+
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", cacheControlValue)
+				w.Write([]byte(expectedResponseCached))
+			})
+		case 2: // Request 2 is within TTL and served from cache.
+			expectedBody = expectedResponseCached
+			expectedOriginRequests = 1
+
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "no-store")
+				w.Write([]byte(expectedResponseUncached))
+			})
+		case 3: // Request 3 is after expiry and goes to origin.
+			time.Sleep(cacheDurationWithBuffer)
+			expectedBody = expectedResponseUncached
+			expectedOriginRequests = 2
+		case 4: // Request 4 goes to origin because of no-store.
+			expectedBody = expectedResponseUncached
+			expectedOriginRequests = 3
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+
+		if count := originServer.RequestCountForPath(req.URL.RequestURI()); count != expectedOriginRequests {
+			t.Errorf(
+				"Origin received wrong number of requests after request %d. Expected %d, got %d",
+				requestCount,
+				expectedOriginRequests,
+				count,
+			)
+		}
+	}
+}
+
+// Should coalesce concurrent requests for an expired `must-revalidate`
+// object into a single conditional request to origin, and serve the
+// revalidated object to all of the clients that were waiting on it.
+func TestCacheRevalidationCoalesced(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cacheDuration = time.Duration(2 * time.Second)
+	const cacheDurationWithBuffer = cacheDuration * 2
+	const originDelay = time.Duration(1 * time.Second)
+	const concurrentRequests = 5
+	const etag = `"unchanged"`
+	const expectedBody = "revalidated once"
+
+	cacheControlValue := fmt.Sprintf("max-age=%.0f, must-revalidate", cacheDuration.Seconds())
+	var conditionalRequests int32
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cacheControlValue)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&conditionalRequests, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	time.Sleep(cacheDurationWithBuffer)
+
+	// Hold the revalidation open long enough for every concurrent
+	// request to arrive at edge while it is still in flight.
+	originServer.ResponseDelay = originDelay
+
+	for count, resp := range RoundTripConcurrently(t, req, concurrentRequests) {
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf(
+				"Concurrent request %d received incorrect status %q",
+				count+1,
+				resp.Status,
+			)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Concurrent request %d received incorrect response body. Expected %q, got %q",
+				count+1,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+
+	if count := originServer.RequestCountForPath(req.URL.RequestURI()); count > 2 {
+		t.Errorf(
+			"Origin received too many requests for %q. Expected at most 2, got %d",
+			req.URL.RequestURI(),
+			count,
+		)
+	}
+	if count := atomic.LoadInt32(&conditionalRequests); count > 1 {
+		t.Errorf("Origin received too many conditional requests. Expected at most 1, got %d", count)
+	}
+}
+
+// Should not cache or serve a truncated response when origin closes the
+// connection part way through writing the body. The client should receive
+// either an error or a complete body, and a subsequent request should get
+// a complete body from origin once it has recovered.
+func TestCacheTruncatedResponseNotCached(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "a complete response body that origin only sends part of the first time"
+	const cutAt = 10
+	const cacheControlValue = "max-age=3600"
+
+	abortHandler := abortAfterHandler([]byte(expectedBody), cutAt)
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cacheControlValue)
+		abortHandler(w, r)
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	resp, err := client.RoundTrip(req)
+	if err != nil {
+		t.Logf("Request 1 received error from edge, which is acceptable: %s", err)
+	} else {
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		switch {
+		case err != nil:
+			t.Logf("Request 1 received truncated body from edge, which is acceptable: %s", err)
+		case resp.StatusCode >= http.StatusInternalServerError:
+			t.Logf("Request 1 received error status from edge, which is acceptable: %q", resp.Status)
+		case string(body) != expectedBody:
+			t.Errorf(
+				"Request 1 received incorrect response body. Expected %q, got %q",
+				expectedBody,
+				string(body),
+			)
+		}
+	}
+
+	requestsBefore := originServer.RequestCountForPath(req.URL.RequestURI())
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", cacheControlValue)
+		w.Write([]byte(expectedBody))
+	})
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Request 2 received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+
+	if count := originServer.RequestCountForPath(req.URL.RequestURI()) - requestsBefore; count != 1 {
+		t.Errorf(
+			"Origin received wrong number of requests after truncated response. Expected 1, got %d",
+			count,
+		)
+	}
+}
+
+// Should keep separate caches for separate hosts, so that an object cached
+// for a path on -edgeHost is not served for the same path on -edgeHost2.
+// Both hosts must be configured to use the same origin.
+func TestCacheHostsIsolated(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if *edgeHost2 == "" {
+		t.Skip("-edgeHost2 not set")
+	}
+
+	const respHeaderName = "Request-Host"
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set(respHeaderName, r.Host)
+	})
+
+	req1 := NewUniqueEdgeGET(t)
+	req2 := req1.Clone(req1.Context())
+	req2.URL.Host = *edgeHost2
+	req2.Host = *edgeHost2
+
+	for requestCount, req := range []*http.Request{req1, req2} {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if recVal := resp.Header.Get(respHeaderName); recVal != req.Host {
+			t.Errorf(
+				"Request %d received wrong %q header. Expected %q, got %q",
+				requestCount+1,
+				respHeaderName,
+				req.Host,
+				recVal,
+			)
+		}
+	}
+
+	if count := originServer.RequestCountForPath(req1.URL.RequestURI()); count != 2 {
+		t.Errorf(
+			"Origin received wrong number of requests for both hosts. Expected 2, got %d",
+			count,
+		)
+	}
+}
+
+// Should forward each client's own address to origin and, because origin
+// doesn't send a `Vary` header, serve the content that origin generated for
+// the first client to a second client at a different address, rather than
+// implicitly keying the cache on the client's address. The second client
+// connects over the other address family, so is skipped if that isn't
+// available.
+func TestCacheNotKeyedOnClientIP(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	ipHandler := clientIPHandler()
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		ipHandler(w, r)
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstIP := net.ParseIP(string(body))
+	if firstIP == nil {
+		t.Fatalf("Origin didn't receive a valid client IP. Got %q", string(body))
+	}
+
+	otherClient := clientIPv6
+	if firstIP.To4() == nil {
+		otherClient = clientIPv4
+	}
+
+	// Same URL from the second client, which should be served from cache.
+	resp, err = otherClient.RoundTrip(req)
+	if err != nil {
+		t.Skip("Unable to connect to edge over other address family: ", err)
+	}
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cachedIP := net.ParseIP(string(body)); !firstIP.Equal(cachedIP) {
+		t.Errorf(
+			"Request from second client received incorrect client IP. Expected %q, got %q",
+			firstIP,
+			string(body),
+		)
+	}
+
+	// New URL from the second client, which origin should see its IP for.
+	req = NewUniqueEdgeGET(t)
+	resp, err = otherClient.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secondIP := net.ParseIP(string(body)); secondIP == nil || secondIP.Equal(firstIP) {
+		t.Errorf(
+			"Origin didn't receive the second client's IP. Expected an IP other than %q, got %q",
+			firstIP,
+			string(body),
+		)
+	}
+
+	if count := originServer.RequestCount(); count != 2 {
+		t.Errorf("Origin received wrong number of requests. Expected 2, got %d", count)
+	}
+}
+
+// Should not compress a response that origin has already compressed. The
+// `Content-Encoding` header should contain a single `gzip` and the body
+// should decompress once to the original content, for both the response
+// from origin and the cached response.
+func TestCacheGzipNotDoubleCompressed(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "compressed once and only once"
+	const expectedContentEncoding = "gzip"
+
+	restoreCompression := disableClientCompression()
+	defer restoreCompression()
+
+	gzbuf := new(bytes.Buffer)
+	gzwriter := gzip.NewWriter(gzbuf)
+	gzwriter.Write([]byte(expectedBody))
+	gzwriter.Close()
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(gzbuf.Bytes())
+	})
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	for requestCount := 1; requestCount < 3; requestCount++ {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if headerVals := resp.Header.Values("Content-Encoding"); strings.Join(headerVals, ", ") != expectedContentEncoding {
+			t.Fatalf(
+				"Request %d received incorrect Content-Encoding header. Expected %q, got %q",
+				requestCount,
+				expectedContentEncoding,
+				strings.Join(headerVals, ", "),
+			)
+		}
+
+		gzreader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gzreader.Close()
+
+		body, err := ioutil.ReadAll(gzreader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body after decompression. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
+// Should respond with `504 Gateway Timeout`, without contacting origin, to
+// a request with `Cache-Control: only-if-cached` for an object that isn't
+// in cache, as required by RFC 7234 section 5.2.1.7. Once the object has
+// been cached, the same request should be served from cache.
+func TestCacheReqHeaderOnlyIfCached(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if vendorCloudflare {
+		t.Skip(notSupportedByVendor)
+	}
+
+	const expectedBody = "only if cached"
+	const expectedStatusUncached = http.StatusGatewayTimeout
+
+	req := NewUniqueEdgeGET(t)
+
+	onlyIfCachedReq := req.Clone(req.Context())
+	onlyIfCachedReq.Header.Set("Cache-Control", "only-if-cached")
+
+	// Guard the mirrors too, in case a 504 is the result of failover.
+	for _, backend := range backendsByPriority {
+		backend.ExpectNoRequests(t)
+	}
+
+	resp := RoundTripCheckError(t, onlyIfCachedReq)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatusUncached {
+		t.Errorf(
+			"Uncached request received incorrect status. Expected %d, got %q",
+			expectedStatusUncached,
+			resp.Status,
+		)
+	}
+
+	resp = populateCache(t, req, expectedBody, nil)
+	defer resp.Body.Close()
+
+	resp = RoundTripCheckError(t, onlyIfCachedReq)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Cached request received incorrect status %q", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Cached request received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+}
+
+// Should serve `GET` and `HEAD` requests for the same URL correctly in
+// either order. Whether they share a cache entry is vendor specific, so it
+// is logged rather than asserted. Each response from origin has a unique
+// ID so that we can tell which one was served. Origin never counts `HEAD`
+// requests, which CDNBackendServer swallows as health checks and marks with
+// a `PING` header, so those are detected by the header instead.
+func TestCacheMethodKey(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "cached for one method or both"
+	const respHeaderName = "Response-ID"
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(respHeaderName, NewUUID())
+		w.Write([]byte(expectedBody))
+	})
+
+	for _, methods := range [][]string{{"GET", "HEAD"}, {"HEAD", "GET"}} {
+		t.Run(strings.Join(methods, "-then-"), func(t *testing.T) {
+			req := NewUniqueEdgeGET(t)
+			var responseIDs []string
+
+			for _, method := range methods {
+				req.Method = method
+				resp := RoundTripCheckError(t, req)
+				defer resp.Body.Close()
+
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("%s request received incorrect status %q", method, resp.Status)
+				}
+
+				body, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				switch method {
+				case "GET":
+					if bodyStr := string(body); bodyStr != expectedBody {
+						t.Errorf(
+							"GET request received incorrect response body. Expected %q, got %q",
+							expectedBody,
+							bodyStr,
+						)
+					}
+				case "HEAD":
+					if len(body) != 0 {
+						t.Errorf("HEAD request received non-empty response body %q", body)
+					}
+					if resp.Header.Get("PING") != "" {
+						t.Log("HEAD request was passed to origin as HEAD")
+					}
+				}
+
+				responseIDs = append(responseIDs, resp.Header.Get(respHeaderName))
+			}
+
+			originRequests := originServer.RequestCountForPath(req.URL.RequestURI())
+			if responseIDs[0] != "" && responseIDs[0] == responseIDs[1] {
+				t.Logf("%s shared a cache entry, origin received %d GET requests", methods, originRequests)
+			} else {
+				t.Logf("%s used separate cache entries, origin received %d GET requests", methods, originRequests)
 			}
+		})
+	}
+}
+
+// Should give `If-None-Match` precedence over `If-Modified-Since` when a
+// client sends both, as browsers do, per RFC 7232 section 6. A matching
+// ETag with an old date should get a 304, and a mismatched ETag with a
+// current date should get the full response. Origin logs the validators
+// that it receives, in case edge passes them on rather than evaluating them.
+func TestCacheConditionalIfNoneMatchPrecedence(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "validated by ETag before date"
+	const etag = `"current"`
+	lastModified := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		if inm, ims := r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since"); inm != "" || ims != "" {
+			t.Logf("Origin received If-None-Match %q and If-Modified-Since %q", inm, ims)
+		}
+
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", lastModified, strings.NewReader(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	testCases := []struct {
+		ifNoneMatch     string
+		ifModifiedSince time.Time
+		expectedStatus  int
+		expectedBody    string
+	}{
+		{etag, lastModified.Add(-time.Hour), http.StatusNotModified, ""},
+		{`"stale"`, lastModified, http.StatusOK, expectedBody},
+	}
+
+	for requestCount, testCase := range testCases {
+		req.Header.Set("If-None-Match", testCase.ifNoneMatch)
+		req.Header.Set("If-Modified-Since", testCase.ifModifiedSince.Format(http.TimeFormat))
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != testCase.expectedStatus {
+			t.Errorf(
+				"Request %d received incorrect status code. Expected %d, got %d",
+				requestCount+1,
+				testCase.expectedStatus,
+				resp.StatusCode,
+			)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != testCase.expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount+1,
+				testCase.expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
+// Should ignore an `If-Modified-Since` header with a date in the future or
+// a date that can't be parsed, per RFC 7232 section 3.3, and serve the full
+// response rather than a 304. The validators that reached origin, if edge
+// passed them on rather than evaluating them, are logged from its
+// transcript.
+func TestCacheConditionalIfModifiedSinceInvalid(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedStatus = http.StatusOK
+	const expectedBody = "modified whatever you say"
+	lastModified := time.Now().Add(-time.Hour).UTC()
+
+	originServer.Record = true
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	ifModifiedSinceVals := []string{
+		time.Now().Add(time.Hour).UTC().Format(http.TimeFormat),
+		"not-a-date",
+	}
+
+	for _, ifModifiedSince := range ifModifiedSinceVals {
+		req.Header.Set("If-Modified-Since", ifModifiedSince)
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Errorf(
+				"Request with If-Modified-Since %q received incorrect status code. Expected %d, got %d",
+				ifModifiedSince,
+				expectedStatus,
+				resp.StatusCode,
+			)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request with If-Modified-Since %q received incorrect response body. Expected %q, got %q",
+				ifModifiedSince,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+
+	for count, exchange := range originServer.Transcript() {
+		if ims := exchange.RequestHeader.Get("If-Modified-Since"); ims != "" {
+			t.Logf("Origin request %d received If-Modified-Since %q", count+1, ims)
+		}
+	}
+}
+
+// Should cache a redirect from origin, according to its `Cache-Control`
+// header, and serve it from cache with the `Location` header intact. This
+// differs from TestMiscProtocolRedirect, where edge generates the redirect.
+func TestCacheRedirectFromOrigin(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedStatus = http.StatusMovedPermanently
+	const headerName = "Location"
+	const expectedLocation = "https://www.example.com/moved?from=origin"
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount < 3; requestCount++ {
+		switch requestCount {
+		case 1: // Request 1 populates cache.
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=3600")
+				w.Header().Set(headerName, expectedLocation)
+				w.WriteHeader(expectedStatus)
+			})
+		case 2: // Request 2 comes from cache.
+			originServer.ExpectNoRequests(t)
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Errorf(
+				"Request %d received incorrect status code. Expected %d, got %d",
+				requestCount,
+				expectedStatus,
+				resp.StatusCode,
+			)
+		}
+		if dest := resp.Header.Get(headerName); dest != expectedLocation {
+			t.Errorf(
+				"Request %d received incorrect %q header. Expected %q, got %q",
+				requestCount,
+				headerName,
+				expectedLocation,
+				dest,
+			)
 		}
 	}
 }
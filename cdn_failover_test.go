@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
+	"time"
 )
 
 // checkForSkipFailover skips the calling test if the skipFailover flag has
@@ -115,37 +117,91 @@ func TestFailoverErrorPageAllServers5xx(t *testing.T) {
 // (so as not to overwhelm it) if origin returns a 5xx response.
 func TestFailoverOrigin5xxBackOff(t *testing.T) {
 	checkForSkipFailover(t)
+
+	repeatedly(t, *repeatBackOff, func(t *testing.T) {
+		const expectedBody = "lucky golden ticket"
+		const expectedStatus = http.StatusOK
+
+		backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(expectedBody))
+		})
+		backupServer2.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			name := backupServer2.Name
+			t.Errorf("Server %s received request and it shouldn't have", name)
+			w.Write([]byte(name))
+		})
+
+		req := NewUniqueEdgeGET(t)
+
+		for requestCount := 1; requestCount < 21; requestCount++ {
+			switch requestCount {
+			case 1: // Request 1 hits origin but is served from mirror1.
+				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					w.Write([]byte(originServer.Name))
+				})
+			case 2: // Requests 2+ are served directly from mirror1.
+				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+					name := originServer.Name
+					t.Errorf("Server %s received request and it shouldn't have", name)
+					w.Write([]byte(name))
+				})
+			}
+
+			resp := RoundTripCheckError(t, req)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != expectedStatus {
+				t.Errorf(
+					"Request %d received incorrect status code. Expected %d, got %d",
+					requestCount,
+					expectedStatus,
+					resp.StatusCode,
+				)
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bodyStr := string(body); bodyStr != expectedBody {
+				t.Errorf(
+					"Request %d received incorrect response body. Expected %q, got %q",
+					requestCount,
+					expectedBody,
+					bodyStr,
+				)
+			}
+		}
+	})
+}
+
+// Should fallback to first mirror if origin is down and object is not in
+// cache (active or stale). The mirror's response should be cached according
+// to its own headers and served from cache while origin is still down.
+func TestFailoverOriginDownUseFirstMirror(t *testing.T) {
+	checkForSkipFailover(t)
 	ResetBackends(backendsByPriority)
 
-	const expectedBody = "lucky golden ticket"
-	const expectedStatus = http.StatusOK
+	expectedBody := "lucky golden ticket"
+	expectedStatus := http.StatusOK
+	expectedMirrorRequests := 1
 
+	originServer.Stop()
 	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
 		w.Write([]byte(expectedBody))
 	})
 	backupServer2.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
 		name := backupServer2.Name
-		t.Errorf("Server %s received request and it shouldn't have", name)
+		t.Errorf("Server %s received a request and it shouldn't have", name)
 		w.Write([]byte(name))
 	})
 
 	req := NewUniqueEdgeGET(t)
 
-	for requestCount := 1; requestCount < 21; requestCount++ {
-		switch requestCount {
-		case 1: // Request 1 hits origin but is served from mirror1.
-			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(http.StatusServiceUnavailable)
-				w.Write([]byte(originServer.Name))
-			})
-		case 2: // Requests 2+ are served directly from mirror1.
-			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-				name := originServer.Name
-				t.Errorf("Server %s received request and it shouldn't have", name)
-				w.Write([]byte(name))
-			})
-		}
-
+	// Request 1 from mirror, request 2 from cache while origin is still down.
+	for requestCount := 1; requestCount < 3; requestCount++ {
 		resp := RoundTripCheckError(t, req)
 		defer resp.Body.Close()
 
@@ -171,48 +227,13 @@ func TestFailoverOrigin5xxBackOff(t *testing.T) {
 			)
 		}
 	}
-}
-
-// Should fallback to first mirror if origin is down and object is not in
-// cache (active or stale).
-func TestFailoverOriginDownUseFirstMirror(t *testing.T) {
-	checkForSkipFailover(t)
-	ResetBackends(backendsByPriority)
-
-	expectedBody := "lucky golden ticket"
-	expectedStatus := http.StatusOK
-
-	originServer.Stop()
-	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(expectedBody))
-	})
-	backupServer2.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-		name := backupServer2.Name
-		t.Errorf("Server %s received a request and it shouldn't have", name)
-		w.Write([]byte(name))
-	})
 
-	req := NewUniqueEdgeGET(t)
-	resp := RoundTripCheckError(t, req)
-	defer resp.Body.Close()
-
-	if resp.StatusCode != expectedStatus {
+	if count := backupServer1.RequestCountForPath(req.URL.RequestURI()); count != expectedMirrorRequests {
 		t.Errorf(
-			"Received incorrect status code. Expected %d, got %d",
-			expectedStatus,
-			resp.StatusCode,
-		)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if bodyStr := string(body); bodyStr != expectedBody {
-		t.Errorf(
-			"Received incorrect response body. Expected %q, got %q",
-			expectedBody,
-			bodyStr,
+			"Server %s received wrong number of requests. Expected %d, got %d",
+			backupServer1.Name,
+			expectedMirrorRequests,
+			count,
 		)
 	}
 }
@@ -279,7 +300,8 @@ func TestFailoverOrigin5xxUseFirstMirror(t *testing.T) {
 }
 
 // Should fallback to second mirror if both origin and first mirror are
-// down.
+// down. The second mirror is the last of backendsByPriority, so this will
+// work for any number of mirrors.
 func TestFailoverOriginDownFirstMirrorDownUseSecondMirror(t *testing.T) {
 	checkForSkipFailover(t)
 	ResetBackends(backendsByPriority)
@@ -287,9 +309,11 @@ func TestFailoverOriginDownFirstMirrorDownUseSecondMirror(t *testing.T) {
 	expectedBody := "lucky golden ticket"
 	expectedStatus := http.StatusOK
 
-	originServer.Stop()
-	backupServer1.Stop()
-	backupServer2.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	lastBackendIndex := len(backendsByPriority) - 1
+	for _, backend := range backendsByPriority[:lastBackendIndex] {
+		backend.Stop()
+	}
+	backendsByPriority[lastBackendIndex].SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(expectedBody))
 	})
 
@@ -384,6 +408,152 @@ func TestFailoverOrigin5xxFirstMirror5xxUseSecondMirror(t *testing.T) {
 	}
 }
 
+// Should always serve from the highest priority backend that is healthy,
+// whether the backends preceding it are down or returning 5xx responses, and
+// not send requests to any backends after it. Iterates over
+// backendsByPriority so that it works for any number of mirrors.
+func TestFailoverHighestPriorityHealthyBackend(t *testing.T) {
+	checkForSkipFailover(t)
+
+	const expectedStatus = http.StatusOK
+	failureModes := []string{"down", "5xx"}
+
+	for _, failureMode := range failureModes {
+		for healthyIndex, healthyBackend := range backendsByPriority {
+			ResetBackends(backendsByPriority)
+
+			for _, backend := range backendsByPriority[:healthyIndex] {
+				backend := backend
+				switch failureMode {
+				case "down":
+					backend.Stop()
+				case "5xx":
+					backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						w.Write([]byte(backend.Name))
+					})
+				}
+			}
+
+			healthyBackend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(healthyBackend.Name))
+			})
+
+			for _, backend := range backendsByPriority[healthyIndex+1:] {
+				backend := backend
+				backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+					t.Errorf("Server %s received request and it shouldn't have", backend.Name)
+					w.Write([]byte(backend.Name))
+				})
+			}
+
+			req := NewUniqueEdgeGET(t)
+			resp := RoundTripCheckError(t, req)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != expectedStatus {
+				t.Errorf(
+					"Received incorrect status code with %d backends %s. Expected %d, got %d",
+					healthyIndex,
+					failureMode,
+					expectedStatus,
+					resp.StatusCode,
+				)
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bodyStr := string(body); bodyStr != healthyBackend.Name {
+				t.Errorf(
+					"Received response from wrong backend with %d backends %s. Expected %q, got %q",
+					healthyIndex,
+					failureMode,
+					healthyBackend.Name,
+					bodyStr,
+				)
+			}
+		}
+	}
+}
+
+// Should serve origin's response once origin has recovered and the object
+// served by a mirror during failover has expired. The mirror's response
+// must not persist in cache as if it had come from origin.
+func TestFailoverOriginRecoveredAfterMirrorCached(t *testing.T) {
+	checkForSkipFailover(t)
+	ResetBackends(backendsByPriority)
+
+	const expectedResponseMirror = "served by mirror"
+	const expectedResponseOrigin = "served by recovered origin"
+	const expectedStatus = http.StatusOK
+	const respTTL = time.Duration(2 * time.Second)
+	const respTTLWithBuffer = 2 * respTTL
+	headerValue := fmt.Sprintf("max-age=%.0f", respTTL.Seconds())
+
+	req := NewUniqueEdgeGET(t)
+
+	var expectedBody string
+	for requestCount := 1; requestCount < 3; requestCount++ {
+		switch requestCount {
+		case 1: // Request 1 is served by mirror while origin is down.
+			expectedBody = expectedResponseMirror
+
+			originServer.Stop()
+			backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", headerValue)
+				w.Write([]byte(expectedBody))
+			})
+		case 2: // Request 2 is served by origin after it has recovered.
+			expectedBody = expectedResponseOrigin
+
+			ResetBackends(backendsByPriority)
+			time.Sleep(respTTLWithBuffer)
+
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(expectedBody))
+			})
+			backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				name := backupServer1.Name
+				t.Errorf("Server %s received request and it shouldn't have", name)
+				w.Write([]byte(name))
+			})
+		}
+
+		backupServer2.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			name := backupServer2.Name
+			t.Errorf("Server %s received request and it shouldn't have", name)
+			w.Write([]byte(name))
+		})
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Errorf(
+				"Request %d received incorrect status code. Expected %d, got %d",
+				requestCount,
+				expectedStatus,
+				resp.StatusCode,
+			)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
 // Should not fallback to mirror if origin returns a 5xx response with a
 // No-Fallback header. In order to allow applications to present their own
 // error pages.
@@ -436,3 +606,141 @@ func TestFailoverNoFallbackHeader(t *testing.T) {
 		)
 	}
 }
+
+// Should cache responses in the same way regardless of which backend is
+// serving them, to catch differences in configuration between origin and
+// the mirrors.
+func TestFailoverCachingSameForAllBackends(t *testing.T) {
+	checkForSkipFailover(t)
+
+	forEachBackendAsOrigin(t, func(t *testing.T, backend *CDNBackendServer) {
+		const expectedBody = "cached from any backend"
+
+		backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Write([]byte(expectedBody))
+		})
+
+		req := NewUniqueEdgeGET(t)
+
+		for requestCount := 1; requestCount < 3; requestCount++ {
+			resp := RoundTripCheckError(t, req)
+			defer resp.Body.Close()
+
+			if name := resp.Header.Get("Backend-Name"); name != backend.Name {
+				t.Errorf(
+					"Request %d received incorrect Backend-Name header. Expected %q, got %q",
+					requestCount,
+					backend.Name,
+					name,
+				)
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bodyStr := string(body); bodyStr != expectedBody {
+				t.Errorf(
+					"Request %d received incorrect response body. Expected %q, got %q",
+					requestCount,
+					expectedBody,
+					bodyStr,
+				)
+			}
+		}
+
+		if count := backend.RequestCountForPath(req.URL.RequestURI()); count != 1 {
+			t.Errorf(
+				"Server %s received wrong number of requests. Expected 1, got %d",
+				backend.Name,
+				count,
+			)
+		}
+	})
+}
+
+// Should time out an origin that is slower to respond than the first byte
+// timeout that edge is configured with, rather than holding the client's
+// request open until the client gives up. Depending on configuration, given
+// by -slowOrigin, edge either responds with a 504 or fails over to the
+// first mirror. The response must arrive shortly after edge's timeout and
+// before origin would have responded.
+func TestFailoverSlowOriginTimeout(t *testing.T) {
+	if *originTimeout == 0 {
+		t.Skip("Edge origin timeout not specified, see -originTimeout")
+	}
+
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "faster than origin"
+	originDelay := *originTimeout * 2
+
+	// Allow the client to wait longer than origin's delay, so that only
+	// edge's timeout can cut the request short. Restore after the test.
+	origClientResponseHeaderTimeout := client.ResponseHeaderTimeout
+	client.ResponseHeaderTimeout = originDelay + requestTimeout
+	defer func() {
+		client.ResponseHeaderTimeout = origClientResponseHeaderTimeout
+	}()
+
+	var expectedStatus int
+	switch *slowOrigin {
+	case "504":
+		expectedStatus = http.StatusGatewayTimeout
+		for _, backend := range backendsByPriority[1:] {
+			backend.ExpectNoRequests(t)
+		}
+	case "failover":
+		checkForSkipFailover(t)
+		expectedStatus = http.StatusOK
+		backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(expectedBody))
+		})
+	default:
+		t.Fatalf("Unrecognised value for -slowOrigin: %q", *slowOrigin)
+	}
+
+	originServer.ResponseDelay = originDelay
+
+	req := NewUniqueEdgeGET(t)
+
+	start := time.Now()
+	resp, err := client.RoundTrip(req)
+	duration := time.Since(start)
+	if err != nil {
+		t.Fatalf("Request failed after %s: %s", duration, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Errorf(
+			"Received incorrect status code. Expected %d, got %d",
+			expectedStatus,
+			resp.StatusCode,
+		)
+	}
+
+	if *slowOrigin == "failover" {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Received incorrect response body. Expected %q, got %q",
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+
+	if duration < *originTimeout || duration >= originDelay {
+		t.Errorf(
+			"Response took %s. Expected at least edge's timeout of %s and less than origin's delay of %s",
+			duration,
+			*originTimeout,
+			originDelay,
+		)
+	}
+}
@@ -1,11 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"strings"
 	"testing"
+	"time"
 )
 
+// checkRequestLimitResponse fails the calling test if the response to a
+// request that may exceed the edge's limits is neither successful nor a
+// sensible client error, such as a 5xx caused by passing it to origin.
+func checkRequestLimitResponse(t *testing.T, resp *http.Response, limitName string) {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		t.Logf("Request with %s was within limit and served", limitName)
+	case http.StatusBadRequest,
+		http.StatusRequestEntityTooLarge,
+		http.StatusRequestURITooLong,
+		http.StatusRequestHeaderFieldsTooLarge:
+		t.Logf("Request with %s exceeded limit and was rejected with %q", limitName, resp.Status)
+	default:
+		t.Errorf("Request with %s received unexpected status %q", limitName, resp.Status)
+	}
+}
+
 // Should redirect from HTTP to HTTPS without hitting origin, whilst
 // preserving path and query params. Fragments are not preserved because the
 // client should reapply them:
@@ -59,11 +83,18 @@ func TestMiscProtocolRedirect(t *testing.T) {
 }
 
 // Should return 403 and not invalidate the edge's cache for PURGE requests
-// that come from IPs not in the whitelist. We assume that this is not
-// running from a whitelisted address.
+// that come from IPs not in the whitelist. The rejection should be served by
+// the edge itself, without reaching any backends or exposing cached content.
+// Skipped if running from a whitelisted address.
 func TestMiscRestrictPurgeRequests(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
+	if *purgeWhitelisted {
+		t.Skip("Running from an address whitelisted for PURGE")
+	}
+
+	const cachedBody = "this should not be purged"
+	const cachedContentType = "application/x-cdn-acceptance-tests"
 	var expectedBody string
 	var expectedStatus int
 	req := NewUniqueEdgeGET(t)
@@ -72,24 +103,24 @@ func TestMiscRestrictPurgeRequests(t *testing.T) {
 		switch requestCount {
 		case 1:
 			req.Method = "GET"
-			expectedBody = "this should not be purged"
+			expectedBody = cachedBody
 			expectedStatus = 200
 
 			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-				w.Write([]byte(expectedBody))
+				w.Header().Set("Content-Type", cachedContentType)
+				w.Write([]byte(cachedBody))
 			})
 		case 2:
 			req.Method = "PURGE"
 			expectedBody = ""
 			expectedStatus = 403
 
-			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-				t.Error("Request should not have made it to origin")
-				w.Write([]byte(originServer.Name))
-			})
+			for _, backend := range backendsByPriority {
+				backend.ExpectNoRequests(t)
+			}
 		case 3:
 			req.Method = "GET"
-			expectedBody = "this should not be purged"
+			expectedBody = cachedBody
 			expectedStatus = 200
 		}
 
@@ -105,16 +136,181 @@ func TestMiscRestrictPurgeRequests(t *testing.T) {
 			)
 		}
 
-		if expectedBody != "" {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodyStr := string(body)
+
+		if expectedBody != "" && bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+
+		if req.Method != "PURGE" {
+			continue
+		}
+
+		if name := resp.Header.Get("Backend-Name"); name != "" {
+			t.Errorf("Request %d received Backend-Name header %q from a backend", requestCount, name)
+		}
+		if contentType := resp.Header.Get("Content-Type"); contentType == cachedContentType {
+			t.Errorf("Request %d received Content-Type %q of cached object", requestCount, contentType)
+		}
+		if strings.Contains(bodyStr, cachedBody) {
+			t.Errorf("Request %d received response body containing cached object: %q", requestCount, bodyStr)
+		}
+	}
+}
+
+// Should stop serving a purged object within -purgeBound of it being
+// purged. We poll until origin receives a new request for the object, which
+// must be within the bound. Skipped unless running from an address
+// whitelisted for PURGE.
+func TestMiscPurgePropagation(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	if !*purgeWhitelisted {
+		t.Skip("Not running from an address whitelisted for PURGE")
+	}
+
+	const pollInterval = time.Duration(100 * time.Millisecond)
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	requestsBefore := originServer.RequestCountForPath(req.URL.RequestURI())
+
+	PurgeEdge(t, req)
+	start := time.Now()
+
+	for originServer.RequestCountForPath(req.URL.RequestURI()) == requestsBefore {
+		if elapsed := time.Since(start); elapsed > *purgeBound {
+			t.Fatalf("Edge still served purged object after %s. Expected within %s", elapsed, *purgeBound)
+		}
+
+		time.Sleep(pollInterval)
+
+		resp := RoundTripCheckError(t, req)
+		resp.Body.Close()
+	}
+
+	t.Logf("Purge took effect within %s", time.Since(start))
+}
+
+// Should either serve a request with a very long URL or reject it with a
+// sensible client error, rather than hanging or returning a 5xx. The length
+// can be changed with -longURL to find the actual limit.
+func TestMiscLongURL(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const paddingParam = "&padding="
+
+	req := NewUniqueEdgeGET(t)
+	if padding := *longURL - len(req.URL.String()) - len(paddingParam); padding > 0 {
+		req.URL.RawQuery += paddingParam + strings.Repeat("a", padding)
+	}
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	checkRequestLimitResponse(t, resp, fmt.Sprintf("%d byte URL", len(req.URL.String())))
+}
+
+// Should either serve a request with many large headers or reject it with a
+// sensible client error, rather than hanging or returning a 5xx. The total
+// size can be changed with -longHeaders to find the actual limit.
+func TestMiscLongHeaders(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerValueSize = 1024
+
+	req := NewUniqueEdgeGET(t)
+	for count := 0; count*headerValueSize < *longHeaders; count++ {
+		headerName := fmt.Sprintf("Padding-%d", count)
+		req.Header.Set(headerName, strings.Repeat("a", headerValueSize))
+	}
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	checkRequestLimitResponse(t, resp, fmt.Sprintf("%d headers", len(req.Header)))
+}
+
+// Should pass uncommon response status codes from origin to the client
+// verbatim, with no body for 204 and 304 responses. A 304 is sent by origin
+// even though the request isn't conditional. All backends return the same
+// status so that 5xx responses aren't replaced by failover. Statuses that
+// are cacheable by default should also be served from cache.
+func TestMiscStatusCodePassthrough(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	statusCodes := []int{201, 202, 204, 206, 301, 302, 304, 307, 308, 410, 418, 451, 503}
+	cacheableStatusCodes := map[int]bool{
+		301: true,
+		410: true,
+	}
+
+	for _, statusCode := range statusCodes {
+		expectedBody := fmt.Sprintf("status %d", statusCode)
+		if statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+			expectedBody = ""
+		}
+
+		for _, backend := range backendsByPriority {
+			backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				if statusCode == http.StatusPartialContent {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(expectedBody)-1, len(expectedBody)))
+				}
+				w.WriteHeader(statusCode)
+				w.Write([]byte(expectedBody))
+			})
+		}
+
+		req := NewUniqueEdgeGET(t)
+
+		for requestCount := 1; requestCount < 3; requestCount++ {
+			if requestCount == 2 {
+				if !cacheableStatusCodes[statusCode] {
+					break
+				}
+
+				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+					t.Errorf("Request for cacheable status %d should not have made it to origin", statusCode)
+					w.WriteHeader(http.StatusOK)
+				})
+			}
+
+			resp := RoundTripCheckError(t, req)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != statusCode {
+				t.Errorf(
+					"Request %d received incorrect status code. Expected %d, got %d",
+					requestCount,
+					statusCode,
+					resp.StatusCode,
+				)
+			}
+
 			body, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
 				t.Fatal(err)
 			}
-
 			if bodyStr := string(body); bodyStr != expectedBody {
 				t.Errorf(
-					"Request %d received incorrect response body. Expected %q, got %q",
+					"Request %d for status %d received incorrect response body. Expected %q, got %q",
 					requestCount,
+					statusCode,
 					expectedBody,
 					bodyStr,
 				)
@@ -122,3 +318,302 @@ func TestMiscRestrictPurgeRequests(t *testing.T) {
 		}
 	}
 }
+
+// Should support persistent connections, so that several sequential
+// requests from the same client reuse a single TCP/TLS connection. The
+// first request may use a new connection or one from a previous test.
+func TestMiscKeepAliveConnectionReuse(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const requestsToMake = 5
+	var connReused bool
+	var connLocalAddr string
+	var firstConnLocalAddr string
+
+	connTrace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			connReused = info.Reused
+			connLocalAddr = info.Conn.LocalAddr().String()
+		},
+	}
+
+	for requestCount := 1; requestCount <= requestsToMake; requestCount++ {
+		req := NewUniqueEdgeGET(t)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), connTrace))
+
+		resp := RoundTripCheckError(t, req)
+
+		// The body must be consumed and closed to release the connection.
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if requestCount == 1 {
+			firstConnLocalAddr = connLocalAddr
+			continue
+		}
+
+		if !connReused {
+			t.Errorf("Request %d didn't reuse an existing connection", requestCount)
+		}
+		if connLocalAddr != firstConnLocalAddr {
+			t.Errorf(
+				"Request %d used a different connection. Expected %s, got %s",
+				requestCount,
+				firstConnLocalAddr,
+				connLocalAddr,
+			)
+		}
+	}
+}
+
+// Should serve many requests made back-to-back on a single persistent
+// connection, as fast as the client can send them, with each response
+// matching its own request. Origin responds with the path that it received,
+// so a response for the wrong request would be noticed.
+func TestMiscKeepAliveRapidRequests(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const requestsToMake = 20
+	var connReused bool
+	var connLocalAddr string
+	var firstConnLocalAddr string
+
+	connTrace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			connReused = info.Reused
+			connLocalAddr = info.Conn.LocalAddr().String()
+		},
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	})
+
+	for requestCount := 1; requestCount <= requestsToMake; requestCount++ {
+		req := NewUniqueEdgeGET(t)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), connTrace))
+		expectedBody := req.URL.RequestURI()
+
+		resp := RoundTripCheckError(t, req)
+
+		// The body must be consumed and closed to release the connection.
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+
+		if requestCount == 1 {
+			firstConnLocalAddr = connLocalAddr
+			continue
+		}
+
+		if !connReused || connLocalAddr != firstConnLocalAddr {
+			t.Errorf(
+				"Request %d didn't reuse the first connection. Expected %s, got %s",
+				requestCount,
+				firstConnLocalAddr,
+				connLocalAddr,
+			)
+		}
+	}
+}
+
+// Should give a controlled response to an `OPTIONS *` request, which
+// applies to the server rather than a resource, without forwarding it to
+// origin. Vendors differ in whether they answer it with an `Allow` header or
+// reject it as unsupported, so any of those responses are accepted and
+// logged, but a generic 400 or a 5xx from a confused proxy is not.
+func TestMiscOptionsAsterisk(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	for _, backend := range backendsByPriority {
+		backend.ExpectNoRequests(t)
+	}
+
+	req := NewUniqueEdgeGET(t)
+	req.Method = "OPTIONS"
+	req.URL.Opaque = "*"
+	req.URL.RawQuery = ""
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		t.Logf("OPTIONS * answered with %q and Allow header %q", resp.Status, resp.Header.Get("Allow"))
+	case http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		t.Logf("OPTIONS * rejected with %q", resp.Status)
+	default:
+		t.Errorf("OPTIONS * received unexpected status %q", resp.Status)
+	}
+}
+
+// Should not look up edge's address again once it has been resolved, even
+// when new connections are made, because the client pins it so as not to
+// switch to another edge location in the middle of the run. Any lookup is
+// reported along with the addresses that it resolved to.
+func TestMiscDNSLookupPinned(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const requestsToMake = 3
+	var connRemoteAddr string
+	var firstConnRemoteAddr string
+
+	dnsTrace := &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			t.Errorf("Unexpected DNS lookup for %q", info.Host)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			t.Errorf("Unexpected DNS lookup resolved to %v", info.Addrs)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			connRemoteAddr = info.Conn.RemoteAddr().String()
+		},
+	}
+
+	for requestCount := 1; requestCount <= requestsToMake; requestCount++ {
+		req := NewUniqueEdgeGET(t)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), dnsTrace))
+		// Force a new connection, and therefore a dial, for every request.
+		req.Close = true
+
+		resp := RoundTripCheckError(t, req)
+		resp.Body.Close()
+
+		if requestCount == 1 {
+			firstConnRemoteAddr = connRemoteAddr
+			continue
+		}
+
+		if connRemoteAddr != firstConnRemoteAddr {
+			t.Errorf(
+				"Request %d connected to a different address. Expected %s, got %s",
+				requestCount,
+				firstConnRemoteAddr,
+				connRemoteAddr,
+			)
+		}
+	}
+}
+
+// Should negotiate the ALPN protocol given by -originALPN when connecting
+// to origin over TLS. Backends only offer `http/1.1`, so this confirms that
+// edge is using ALPN and agrees on HTTP/1.1. Edges that reach backends
+// without ALPN, such as the CI mock through stunnel, skip this test.
+func TestMiscOriginALPN(t *testing.T) {
+	if *originALPN == "" {
+		t.Skip("Expected ALPN protocol not specified, see -originALPN")
+	}
+
+	ResetBackends(backendsByPriority)
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if count := originServer.RequestCountForPath(req.URL.RequestURI()); count != 1 {
+		t.Fatalf("Origin received wrong number of requests. Expected 1, got %d", count)
+	}
+
+	if protocol := originServer.LastNegotiatedProtocol(); protocol != *originALPN {
+		t.Errorf(
+			"Origin negotiated incorrect ALPN protocol with edge. Expected %q, got %q",
+			*originALPN,
+			protocol,
+		)
+	}
+}
+
+// Should close the connection after responding to a request with a
+// `Connection: close` header, signalled by the same header on the response,
+// while still serving the correct content and caching it as normal. Go's
+// transport would close the connection itself, so the request is written to
+// a raw connection, which edge should have closed once the response has
+// been read.
+func TestMiscConnectionClose(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "and then goodbye"
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	rawReq := fmt.Sprintf(
+		"GET %s HTTP/1.1\r\n"+
+			"Host: %s\r\n"+
+			"Connection: close\r\n"+
+			"\r\n",
+		req.URL.RequestURI(),
+		*edgeHost,
+	)
+
+	tlsConn := DialEdgeTLS(t)
+	defer tlsConn.Close()
+
+	if _, err := io.WriteString(tlsConn, rawReq); err != nil {
+		t.Fatal(err)
+	}
+
+	connReader := bufio.NewReader(tlsConn)
+	resp, err := http.ReadResponse(connReader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Request with Connection: close received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+	if !resp.Close {
+		t.Error("Request with Connection: close received response without Connection: close")
+	}
+
+	// Any error other than the deadline passing means edge closed it, with or
+	// without a TLS close_notify.
+	_, err = connReader.ReadByte()
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Errorf("Edge didn't close the connection after responding, read got: %v", err)
+	}
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Request after Connection: close received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+
+	if count := originServer.RequestCountForPath(req.URL.RequestURI()); count != 1 {
+		t.Errorf("Origin received wrong number of requests. Expected 1, got %d", count)
+	}
+}
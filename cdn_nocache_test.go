@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"testing"
+	"time"
 )
 
 // Should send request to origin by default
@@ -80,6 +82,20 @@ func TestNoCacheHeaderCacheControlPrivate(t *testing.T) {
 	testThreeRequestsNotCached(t, req, handler)
 }
 
+// Should not cache a response with a `Cache-Control: private, max-age=n`
+// header. `private` forbids shared caches from storing the response, even
+// though `max-age` would otherwise make it cacheable.
+func TestNoCacheHeaderCacheControlPrivateMaxAge(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	handler := func(h http.Header) {
+		h.Set("Cache-Control", "private, max-age=60")
+	}
+
+	req := NewUniqueEdgeGET(t)
+	testThreeRequestsNotCached(t, req, handler)
+}
+
 // Should not cache a response with a `Cache-Control: max-age=0` header.
 func TestNoCacheHeaderCacheControlMaxAge0(t *testing.T) {
 	ResetBackends(backendsByPriority)
@@ -92,6 +108,20 @@ func TestNoCacheHeaderCacheControlMaxAge0(t *testing.T) {
 	testThreeRequestsNotCached(t, req, handler)
 }
 
+// Should not cache a response with an `Expires` header that isn't a valid
+// date and no `Cache-Control` header. RFC 7234 requires caches to treat an
+// invalid date as being in the past.
+func TestNoCacheHeaderExpiresInvalid(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	handler := func(h http.Header) {
+		h.Set("Expires", "not-a-date")
+	}
+
+	req := NewUniqueEdgeGET(t)
+	testThreeRequestsNotCached(t, req, handler)
+}
+
 // Should not cache a response with a `Vary: *` header.
 func TestNoCacheHeaderVaryAsterisk(t *testing.T) {
 	t.Skip("Not widely supported")
@@ -105,3 +135,71 @@ func TestNoCacheHeaderVaryAsterisk(t *testing.T) {
 	req := NewUniqueEdgeGET(t)
 	testThreeRequestsNotCached(t, req, handler)
 }
+
+// Should not cache a 5xx response as though it were a successful one, even
+// if origin sends it with a `Cache-Control` header that would make it
+// cacheable. Serving an error from cache for the whole of its max-age would
+// prolong an outage long after origin has recovered. Some edges can be
+// intentionally configured to cache errors for a short time to protect
+// origin, which is allowed for by -negativeCache5xx.
+func TestNoCache5xxCacheControl(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedStatus = http.StatusOK
+	const expectedBody = "recovered from an outage"
+	negativeCacheWithBuffer := *negativeCache5xx + (*negativeCache5xx / 4)
+
+	for _, backend := range backendsByPriority {
+		backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=300")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+	}
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf(
+			"Request 1 received incorrect status code. Expected %d, got %d",
+			http.StatusServiceUnavailable,
+			resp.StatusCode,
+		)
+	}
+
+	if negativeCacheWithBuffer > 0 {
+		t.Logf("Waiting %s for negatively cached response to expire", negativeCacheWithBuffer)
+		time.Sleep(negativeCacheWithBuffer)
+	}
+
+	// Origin, or a mirror if edge is backing off origin, has recovered.
+	for _, backend := range backendsByPriority {
+		backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(expectedBody))
+		})
+	}
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Errorf(
+			"Request 2 received incorrect status code. Expected %d, got %d",
+			expectedStatus,
+			resp.StatusCode,
+		)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedBody {
+		t.Errorf(
+			"Request 2 received incorrect response body. Expected %q, got %q",
+			expectedBody,
+			bodyStr,
+		)
+	}
+}
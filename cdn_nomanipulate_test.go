@@ -1,6 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
 	"testing"
 )
 
@@ -13,40 +19,99 @@ import (
 func TestNoManipulationHTML(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
-	testResponseNotManipulated(t, "fixtures/golang.html")
+	testResponseNotManipulated(t, "fixtures/golang.html", nil)
 }
 
 // Should not manipulate CSS content in response bodies.
 func TestNoManipulationCSS(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
-	testResponseNotManipulated(t, "fixtures/golang.css")
+	testResponseNotManipulated(t, "fixtures/golang.css", nil)
 }
 
 // Should not manipulate JavaScript content in response bodies.
 func TestNoManipulationJS(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
-	testResponseNotManipulated(t, "fixtures/golang.js")
+	testResponseNotManipulated(t, "fixtures/golang.js", nil)
 }
 
 // Should not manipulate PNG images in response bodies.
 func TestNoManipulationPNG(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
-	testResponseNotManipulated(t, "fixtures/golang.png")
+	testResponseNotManipulated(t, "fixtures/golang.png", nil)
 }
 
 // Should not manipulate JPEG images in response bodies.
 func TestNoManipulationJPEG(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
-	testResponseNotManipulated(t, "fixtures/golang.jpeg")
+	testResponseNotManipulated(t, "fixtures/golang.jpeg", nil)
 }
 
 // Should not manipulate GIF images in response bodies.
 func TestNoManipulationGIF(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
-	testResponseNotManipulated(t, "fixtures/golang.gif")
+	testResponseNotManipulated(t, "fixtures/golang.gif", nil)
+}
+
+// Should not manipulate JavaScript content in response bodies when origin
+// explicitly opts out of transformation with `Cache-Control: no-transform`.
+func TestNoManipulationNoTransformJS(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	handler := func(w http.ResponseWriter) {
+		w.Header().Set("Cache-Control", "no-transform")
+	}
+
+	testResponseNotManipulated(t, "fixtures/golang.js", handler)
+}
+
+// Should not manipulate JPEG images in response bodies when origin
+// explicitly opts out of transformation with `Cache-Control: no-transform`.
+func TestNoManipulationNoTransformJPEG(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	handler := func(w http.ResponseWriter) {
+		w.Header().Set("Cache-Control", "no-transform")
+	}
+
+	testResponseNotManipulated(t, "fixtures/golang.jpeg", handler)
+}
+
+// Should not inject scripts into HTML response bodies, such as analytics,
+// tracking, or Cloudflare's Rocket Loader, which may be enabled by default
+// for some zones. The fixture contains no scripts, so the body must have its
+// exact length and checksum and not contain any `<script` tags.
+func TestNoManipulationHTMLNoInjectedScripts(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const fixtureFile = "fixtures/minimal.html"
+	const expectedLength = 168
+	const expectedChecksum = "c1e359c965f34adddb7ce595d2a11a3531304e74ab52f99a3ce74d6f5c4007ae"
+
+	originServer.ServeFixtures(filepath.Dir(fixtureFile))
+
+	req := NewUniqueEdgeGET(t)
+	req.URL.Path = "/" + filepath.Base(fixtureFile)
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if length := len(body); length != expectedLength {
+		t.Errorf("Response body has incorrect length. Expected %d, got %d", expectedLength, length)
+	}
+	if checksum := fmt.Sprintf("%x", sha256.Sum256(body)); checksum != expectedChecksum {
+		t.Errorf("Response body has incorrect checksum. Expected %s, got %s", expectedChecksum, checksum)
+	}
+	if bytes.Contains(bytes.ToLower(body), []byte("<script")) {
+		t.Errorf("Response body contains an injected script: %q", body)
+	}
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Should either forward the body of a GET request to origin intact or
+// ignore it, but not make the body part of the cache key. A subsequent GET
+// with a different body should be served from cache.
+func TestReqBodyGET(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "cacheable response"
+	reqBodies := []string{
+		"first request body",
+		"second request body",
+	}
+	var receivedReqBody string
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		receivedReqBody = string(body)
+
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeRequest(t, "GET", strings.NewReader(reqBodies[0]))
+
+	for requestCount, reqBody := range reqBodies {
+		requestCount = requestCount + 1
+		if requestCount == 2 {
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Request should not have made it to origin")
+				w.Write([]byte("not cached"))
+			})
+
+			req.Body = ioutil.NopCloser(strings.NewReader(reqBody))
+			req.ContentLength = int64(len(reqBody))
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if requestCount == 1 && receivedReqBody != reqBody && receivedReqBody != "" {
+			t.Errorf(
+				"Origin received modified request body. Expected %q or nothing, got %q",
+				reqBody,
+				receivedReqBody,
+			)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
+// Should forward the complete body of a POST request sent with chunked
+// transfer encoding, which is used when the length isn't known in advance.
+// Logs whether the edge buffered the body to add a `Content-Length`.
+func TestReqBodyChunkedPOST(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	reqBody := strings.Repeat("chunked request body ", 4096)
+	expectedHash := sha256.Sum256([]byte(reqBody))
+	var receivedHash [sha256.Size]byte
+	var receivedLength int
+	var receivedContentLength int64
+	var receivedTransferEncoding []string
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		receivedHash = sha256.Sum256(body)
+		receivedLength = len(body)
+		receivedContentLength = r.ContentLength
+		receivedTransferEncoding = r.TransferEncoding
+	})
+
+	// Hide the length of the body from the transport so that it is chunked.
+	bodyReader := struct{ io.Reader }{strings.NewReader(reqBody)}
+	req := NewUniqueEdgeRequest(t, "POST", bodyReader)
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Request received incorrect status %q", resp.Status)
+	}
+
+	if receivedHash != expectedHash {
+		t.Errorf(
+			"Origin received incorrect request body. Expected %d bytes with hash %x, got %d bytes with hash %x",
+			len(reqBody),
+			expectedHash,
+			receivedLength,
+			receivedHash,
+		)
+	}
+
+	if receivedContentLength >= 0 {
+		t.Logf("Edge buffered request body and sent Content-Length %d", receivedContentLength)
+	} else {
+		t.Logf("Edge relayed request body with Transfer-Encoding %q", receivedTransferEncoding)
+	}
+}
+
+// Should forward the complete body of a POST request sent with `Expect:
+// 100-continue`, either by relaying the handshake or by buffering the body,
+// to origin and, if failover tests are enabled, to the first mirror when
+// origin is down.
+func TestReqBodyExpectContinue(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	reqBody := strings.Repeat("expected request body ", 1024)
+	expectedHash := sha256.Sum256([]byte(reqBody))
+
+	// Tell the transport to wait for `100 Continue` before sending the body.
+	// Restore the setting after the test.
+	origClientExpectContinueTimeout := client.ExpectContinueTimeout
+	client.ExpectContinueTimeout = requestTimeout
+	defer func() {
+		client.ExpectContinueTimeout = origClientExpectContinueTimeout
+	}()
+
+	backends := []*CDNBackendServer{originServer}
+	if !*skipFailover {
+		backends = append(backends, backupServer1)
+	}
+
+	for _, backend := range backends {
+		var receivedHash [sha256.Size]byte
+		var receivedLength int
+
+		if backend != originServer {
+			originServer.Stop()
+			backupServer2.ExpectNoRequests(t)
+		}
+
+		backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+
+			receivedHash = sha256.Sum256(body)
+			receivedLength = len(body)
+		})
+
+		req := NewUniqueEdgeRequest(t, "POST", strings.NewReader(reqBody))
+		req.Header.Set("Expect", "100-continue")
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Request to %s received incorrect status %q", backend.Name, resp.Status)
+		}
+
+		if receivedHash != expectedHash {
+			t.Errorf(
+				"Server %s received incorrect request body. Expected %d bytes with hash %x, got %d bytes with hash %x",
+				backend.Name,
+				len(reqBody),
+				expectedHash,
+				receivedLength,
+				receivedHash,
+			)
+		}
+	}
+}
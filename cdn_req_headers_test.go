@@ -75,6 +75,79 @@ func TestReqHeaderXFFCreateAndAppend(t *testing.T) {
 	}
 }
 
+// Should append the client's IP to an `X-Forwarded-For` header containing
+// multiple values, some of which aren't valid IPs. The -xffPolicy flag
+// selects whether the edge is expected to preserve the values provided by
+// the client ("permissive") or remove those that aren't IPs ("strict"). This
+// test will not work if run from behind a proxy that also sets XFF.
+func TestReqHeaderXFFSanitize(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerName = "X-Forwarded-For"
+	const sentHeaderVal = "not-an-ip, 203.0.113.99"
+	var ourReportedIP net.IP
+	var receivedHeaderVal string
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaderVal = r.Header.Get(headerName)
+	})
+
+	// First request with no existing XFF to determine our IP.
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	ourReportedIP = net.ParseIP(receivedHeaderVal)
+	if ourReportedIP == nil {
+		t.Fatalf(
+			"Expected origin to receive %q header with single IP. Got %q",
+			headerName,
+			receivedHeaderVal,
+		)
+	}
+
+	var expectedHeaderVals []string
+	switch *xffPolicy {
+	case "permissive":
+		expectedHeaderVals = []string{"not-an-ip", "203.0.113.99", ourReportedIP.String()}
+	case "strict":
+		expectedHeaderVals = []string{"203.0.113.99", ourReportedIP.String()}
+	default:
+		t.Fatalf("X-Forwarded-For policy %q unrecognised", *xffPolicy)
+	}
+
+	// Second request with existing XFF containing an invalid value.
+	req = NewUniqueEdgeGET(t)
+	req.Header.Set(headerName, sentHeaderVal)
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	receivedHeaderVals := strings.Split(receivedHeaderVal, ",")
+	if count := len(receivedHeaderVals); count != len(expectedHeaderVals) {
+		t.Fatalf(
+			"Origin received %q header with wrong count of values. Expected %q, got %d: %q",
+			headerName,
+			expectedHeaderVals,
+			count,
+			receivedHeaderVal,
+		)
+	}
+
+	for count, expectedVal := range expectedHeaderVals {
+		receivedVal := strings.TrimSpace(receivedHeaderVals[count])
+		if receivedVal != expectedVal {
+			t.Errorf(
+				"Origin received %q header with wrong value #%d. Expected %q, got %q",
+				headerName,
+				count+1,
+				expectedVal,
+				receivedVal,
+			)
+		}
+	}
+}
+
 // Should create a True-Client-IP header containing the client's IP
 // address, discarding the value provided in the original request. The name
 // of this header must be consistent across all vendors.
@@ -106,6 +179,39 @@ func TestReqHeaderUnspoofableClientIP(t *testing.T) {
 	}
 }
 
+// Should create a True-Client-IP header containing the client's IPv6
+// address when it connects over IPv6. The address must not be in the
+// IPv4-mapped or bracketed forms, which origin may be unable to parse. Skips
+// if we are unable to connect to the edge over IPv6.
+func TestReqHeaderUnspoofableClientIPv6(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerName = "True-Client-IP"
+	var receivedHeaderVal string
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaderVal = r.Header.Get(headerName)
+	})
+
+	ipv6Client := newEdgeTransport("tcp6")
+	defer ipv6Client.CloseIdleConnections()
+
+	req := NewUniqueEdgeGET(t)
+	resp, err := ipv6Client.RoundTrip(req)
+	if err != nil {
+		t.Skip("Unable to connect to edge over IPv6: ", err)
+	}
+	defer resp.Body.Close()
+
+	receivedHeaderIP := net.ParseIP(receivedHeaderVal)
+	if receivedHeaderIP == nil {
+		t.Fatalf("Origin received %q header with non-IP value %q", headerName, receivedHeaderVal)
+	}
+	if receivedHeaderIP.To4() != nil {
+		t.Errorf("Origin received %q header with non-IPv6 value %q", headerName, receivedHeaderVal)
+	}
+}
+
 // Should not modify `Host` header from original request.
 func TestReqHeaderHostUnmodified(t *testing.T) {
 	const headerName = "Host"
@@ -140,3 +246,148 @@ func TestReqHeaderHostUnmodified(t *testing.T) {
 		)
 	}
 }
+
+// Should not modify `Referer` header from original request, including any
+// query params or fragment-like values that it contains.
+func TestReqHeaderRefererUnmodified(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerName = "Referer"
+	sentHeaderVals := []string{
+		"https://www.example.com/",
+		"https://www.example.com/search?q=cdn&page=2",
+		"https://www.example.com/guide#section-2",
+	}
+	var receivedHeaderVal string
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedHeaderVal = r.Header.Get(headerName)
+	})
+
+	for _, sentHeaderVal := range sentHeaderVals {
+		receivedHeaderVal = ""
+
+		req := NewUniqueEdgeGET(t)
+		req.Header.Set(headerName, sentHeaderVal)
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if receivedHeaderVal != sentHeaderVal {
+			t.Errorf(
+				"Origin received %q header with modified value. Expected %q, got %q",
+				headerName,
+				sentHeaderVal,
+				receivedHeaderVal,
+			)
+		}
+	}
+}
+
+// Should forward the `Authorization` header from the original request to
+// origin unmodified, so that origin can authenticate the client, rather
+// than stripping it. Whether the response is then cached is covered by
+// TestCacheHeaderAuthorization.
+func TestReqHeaderAuthorizationUnmodified(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerName = "Authorization"
+	const sentHeaderVal = "Basic YXJlbnR5b3U6aW5xdWlzaXRpdmU="
+
+	originServer.Record = true
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set(headerName, sentHeaderVal)
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	transcript := originServer.Transcript()
+	if len(transcript) == 0 {
+		t.Fatal("Origin didn't receive request")
+	}
+
+	if receivedHeaderVal := transcript[0].RequestHeader.Get(headerName); receivedHeaderVal != sentHeaderVal {
+		t.Errorf(
+			"Origin received %q header with modified value. Expected %q, got %q",
+			headerName,
+			sentHeaderVal,
+			receivedHeaderVal,
+		)
+	}
+}
+
+// Should allow a request to be correlated between the client, edge and
+// origin. An `X-Request-Id` sent by the client should reach origin
+// unmodified, and origin's echo of it should reach the client. Where the
+// vendor also generates its own ID for each request, that ID should be
+// given to both origin and the client.
+func TestReqHeaderRequestID(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerName = "X-Request-Id"
+	var vendorHeaderName string
+
+	switch {
+	case vendorCloudflare:
+		vendorHeaderName = "CF-Ray"
+	case vendorFastly:
+		// Doesn't generate an ID that is sent to origin by default.
+	default:
+		t.Fatal(notImplementedForVendor)
+	}
+
+	originServer.Record = true
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private")
+		w.Header().Set(headerName, r.Header.Get(headerName))
+	})
+
+	sentHeaderVal := NewUUID()
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set(headerName, sentHeaderVal)
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	transcript := originServer.Transcript()
+	if len(transcript) == 0 {
+		t.Fatal("Origin didn't receive request")
+	}
+	receivedHeaders := transcript[0].RequestHeader
+
+	if receivedHeaderVal := receivedHeaders.Get(headerName); receivedHeaderVal != sentHeaderVal {
+		t.Errorf(
+			"Origin received %q header with modified value. Expected %q, got %q",
+			headerName,
+			sentHeaderVal,
+			receivedHeaderVal,
+		)
+	}
+	if echoedHeaderVal := resp.Header.Get(headerName); echoedHeaderVal != sentHeaderVal {
+		t.Errorf(
+			"Received incorrect %q header echoed by origin. Expected %q, got %q",
+			headerName,
+			sentHeaderVal,
+			echoedHeaderVal,
+		)
+	}
+
+	if vendorHeaderName == "" {
+		return
+	}
+
+	generatedHeaderVal := resp.Header.Get(vendorHeaderName)
+	if generatedHeaderVal == "" {
+		t.Fatalf("Response didn't have a %q header generated by edge", vendorHeaderName)
+	}
+	if originHeaderVal := receivedHeaders.Get(vendorHeaderName); originHeaderVal != generatedHeaderVal {
+		t.Errorf(
+			"Origin received incorrect %q header. Expected %q, got %q",
+			vendorHeaderName,
+			generatedHeaderVal,
+			originHeaderVal,
+		)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"reflect"
 	"regexp"
 	"testing"
 	"time"
@@ -12,7 +13,8 @@ import (
 // client by this CDN provider.
 
 // Should set an Age header, when origin doesn't provide one, representing
-// how long the object has been in edge's cache.
+// how long the object has been in edge's cache. It should be 0 for the
+// first response, from origin, and increment on each subsequent hit.
 func TestRespHeaderAgeFromEdge(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
@@ -20,6 +22,7 @@ func TestRespHeaderAgeFromEdge(t *testing.T) {
 	expectedHeaderVals := []string{
 		"0",
 		fmt.Sprintf("%d", secondsToWaitBetweenRequests),
+		fmt.Sprintf("%d", secondsToWaitBetweenRequests*2),
 	}
 
 	req := NewUniqueEdgeGET(t)
@@ -32,7 +35,7 @@ func TestRespHeaderAgeFromEdge(t *testing.T) {
 				w.Header().Set("Cache-Control", "max-age=1800, public")
 				w.Write([]byte("cacheable request"))
 			})
-		case 2:
+		default:
 			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
 				t.Error("Origin received request and it shouldn't have")
 			})
@@ -110,6 +113,73 @@ func TestRespHeaderAgeFromOrigin(t *testing.T) {
 	}
 }
 
+// Should set a Date header in RFC 1123 format that is close to our own
+// clock, for both cache MISS and HIT responses. The Date of a HIT shouldn't
+// be earlier than the MISS, because Age represents the time in cache. The
+// -dateTolerance flag allows for clock drift between us and the edge.
+func TestRespHeaderDate(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const secondsToWaitBetweenRequests = 2
+	var previousDate time.Time
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1800, public")
+		w.Write([]byte("cacheable request"))
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount < 3; requestCount++ {
+		if requestCount == 2 {
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("Origin received request and it shouldn't have")
+			})
+
+			time.Sleep(time.Duration(secondsToWaitBetweenRequests) * time.Second)
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+		now := time.Now()
+
+		headerVal := resp.Header.Get("Date")
+		date, err := http.ParseTime(headerVal)
+		if err != nil {
+			t.Errorf("Request %d received unparseable Date header %q", requestCount, headerVal)
+			continue
+		}
+
+		if formatted := date.UTC().Format(http.TimeFormat); formatted != headerVal {
+			t.Errorf(
+				"Request %d received Date header not in RFC 1123 format. Expected %q, got %q",
+				requestCount,
+				formatted,
+				headerVal,
+			)
+		}
+
+		if skew := now.Sub(date); skew > *dateTolerance || skew < -*dateTolerance {
+			t.Errorf(
+				"Request %d received Date header %q which is %s from our clock, exceeding %s",
+				requestCount,
+				headerVal,
+				skew,
+				*dateTolerance,
+			)
+		}
+
+		if date.Before(previousDate) {
+			t.Errorf(
+				"Request %d received Date header %q which is earlier than the previous response",
+				requestCount,
+				headerVal,
+			)
+		}
+		previousDate = date
+	}
+}
+
 // Should set an X-Cache header containing HIT/MISS from 'origin, itself'
 func TestRespHeaderXCacheAppend(t *testing.T) {
 	ResetBackends(backendsByPriority)
@@ -150,20 +220,6 @@ func TestRespHeaderXCacheAppend(t *testing.T) {
 func TestRespHeaderCacheHitMiss(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
-	var (
-		headerName  string
-		headerValue string
-	)
-
-	switch {
-	case vendorCloudflare:
-		headerName = "CF-Cache-Status"
-	case vendorFastly:
-		headerName = "X-Cache"
-	default:
-		t.Fatal(notImplementedForVendor)
-	}
-
 	expectedHeaderValues := []string{"MISS", "HIT"}
 	const cacheDuration = time.Second
 
@@ -190,17 +246,33 @@ func TestRespHeaderCacheHitMiss(t *testing.T) {
 		resp := RoundTripCheckError(t, req)
 		defer resp.Body.Close()
 
-		headerValue = resp.Header.Get(headerName)
+		assertCacheStatus(t, resp, expectedValue, fmt.Sprintf("Request %d", count+1))
+	}
+}
 
-		if headerValue != expectedValue {
-			t.Errorf(
-				"%s on request %d is wrong: expected %q, got %q",
-				headerName,
-				count+1,
-				expectedValue,
-				headerValue,
-			)
-		}
+// Should report a cache status of 'MISS' then 'HIT' and 'HIT' again for three
+// requests to a cacheable object, confirming that it stays cached, and
+// origin should only receive the first request.
+func TestRespHeaderCacheMissHitHit(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	expectedHeaderValues := []string{"MISS", "HIT", "HIT"}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount, expectedValue := range expectedHeaderValues {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		assertCacheStatus(t, resp, expectedValue, fmt.Sprintf("Request %d", requestCount+1))
+	}
+
+	if count := originServer.RequestCountForPath(req.URL.RequestURI()); count != 1 {
+		t.Errorf("Origin received wrong number of requests. Expected 1, got %d", count)
 	}
 }
 
@@ -238,6 +310,53 @@ func TestRespHeaderServedBy(t *testing.T) {
 
 }
 
+// Should set or pass through the `Server` header consistently. Cloudflare
+// replaces it with its own value, whereas Fastly preserves the value from
+// origin, if any, which matters for fingerprinting and support requests.
+func TestRespHeaderServer(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerName = "Server"
+	const originHeaderVal = "cdn-acceptance-tests-origin"
+	var expectedHeaderVal func(originVal string) string
+
+	switch {
+	case vendorCloudflare:
+		expectedHeaderVal = func(originVal string) string {
+			return "cloudflare"
+		}
+	case vendorFastly:
+		expectedHeaderVal = func(originVal string) string {
+			return originVal
+		}
+	default:
+		t.Fatal(notImplementedForVendor)
+	}
+
+	for _, originVal := range []string{"", originHeaderVal} {
+		originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			if originVal != "" {
+				w.Header().Set(headerName, originVal)
+			}
+		})
+
+		req := NewUniqueEdgeGET(t)
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		expectedVal := expectedHeaderVal(originVal)
+		if receivedVal := resp.Header.Get(headerName); receivedVal != expectedVal {
+			t.Errorf(
+				"Received incorrect %q header when origin sent %q. Expected %q, got %q",
+				headerName,
+				originVal,
+				expectedVal,
+				receivedVal,
+			)
+		}
+	}
+}
+
 // Should set an X-Cache-Hits header containing hit count for this object,
 // from the Edge AND the Origin, assuming Origin sets one.
 // This is in the format "{origin-hit-count}, {edge-hit-count}"
@@ -293,4 +412,127 @@ func TestRespHeaderXCacheHitsAppend(t *testing.T) {
 			xCacheHits,
 		)
 	}
+
+	if count := originServer.RequestCountForPath(req.URL.RequestURI()); count != 1 {
+		t.Errorf("Origin received wrong number of requests. Expected 1, got %d", count)
+	}
+}
+
+// Should pass multiple `Set-Cookie` headers from origin to the client as
+// separate headers, unmodified and in the same order, rather than
+// collapsing them into one. Whether the response is then cached is covered
+// by TestCacheHeaderSetCookie.
+func TestRespHeaderMultipleSetCookie(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerName = "Set-Cookie"
+	expectedHeaderVals := []string{
+		"first=one; Path=/",
+		"second=two; Path=/; Secure",
+		"third=three; Path=/; HttpOnly",
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		for _, headerVal := range expectedHeaderVals {
+			w.Header().Add(headerName, headerVal)
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if receivedHeaderVals := resp.Header.Values(headerName); !reflect.DeepEqual(receivedHeaderVals, expectedHeaderVals) {
+		t.Errorf(
+			"Received incorrect %q headers. Expected %q, got %q",
+			headerName,
+			expectedHeaderVals,
+			receivedHeaderVals,
+		)
+	}
+}
+
+// Should pass application specific headers from origin to the client
+// unmodified, both when the response is fetched from origin and when it's
+// served from cache. This includes a header with an empty value and a
+// header with multiple values.
+func TestRespHeaderCustomPreserved(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	expectedHeaders := http.Header{
+		"X-App-Version":  []string{"1.2.3"},
+		"X-Request-Id":   []string{"set-by-origin"},
+		"X-App-Empty":    []string{""},
+		"X-App-Multiple": []string{"first", "second"},
+	}
+	expectedCacheStatuses := []string{"MISS", "HIT"}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		for headerName, headerVals := range expectedHeaders {
+			for _, headerVal := range headerVals {
+				w.Header().Add(headerName, headerVal)
+			}
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount, expectedCacheStatus := range expectedCacheStatuses {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		assertCacheStatus(t, resp, expectedCacheStatus, fmt.Sprintf("Request %d", requestCount+1))
+
+		for headerName, expectedHeaderVals := range expectedHeaders {
+			if receivedHeaderVals := resp.Header.Values(headerName); !reflect.DeepEqual(receivedHeaderVals, expectedHeaderVals) {
+				t.Errorf(
+					"Request %d received incorrect %q headers. Expected %q, got %q",
+					requestCount+1,
+					headerName,
+					expectedHeaderVals,
+					receivedHeaderVals,
+				)
+			}
+		}
+	}
+}
+
+// Should pass multiple `Link` headers from origin to the client in the
+// order that origin sent them, both when the response is fetched from origin
+// and when it's served from cache. Preload hints are acted on in order, so an
+// edge that reorders or merges them changes what the client does.
+func TestRespHeaderMultipleLinkOrder(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerName = "Link"
+	expectedHeaderVals := []string{
+		"</static/first.css>; rel=preload; as=style",
+		"</static/second.js>; rel=preload; as=script",
+		"</static/third.woff2>; rel=preload; as=font; crossorigin",
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		for _, headerVal := range expectedHeaderVals {
+			w.Header().Add(headerName, headerVal)
+		}
+	})
+
+	req := NewUniqueEdgeGET(t)
+
+	for requestCount := 1; requestCount < 3; requestCount++ {
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if receivedHeaderVals := resp.Header[headerName]; !reflect.DeepEqual(receivedHeaderVals, expectedHeaderVals) {
+			t.Errorf(
+				"Request %d received incorrect %q headers. Expected %q, got %q",
+				requestCount,
+				headerName,
+				expectedHeaderVals,
+				receivedHeaderVals,
+			)
+		}
+	}
 }
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Should reject a request with both `Content-Length` and
+// `Transfer-Encoding: chunked` headers, or handle it unambiguously, rather
+// than forwarding something that origin could interpret as two requests.
+// The body is a terminating chunk followed by a second "smuggled" request,
+// which origin must never receive.
+func TestSecurityContentLengthAndChunked(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	req := NewUniqueEdgeGET(t)
+	reqPath := req.URL.RequestURI()
+	smuggledPath := "/" + NewUUID()
+
+	smuggledBody := fmt.Sprintf(
+		"0\r\n\r\nGET %s HTTP/1.1\r\nHost: %s\r\n\r\n",
+		smuggledPath,
+		*edgeHost,
+	)
+	rawReq := fmt.Sprintf(
+		"POST %s HTTP/1.1\r\n"+
+			"Host: %s\r\n"+
+			"Content-Length: %d\r\n"+
+			"Transfer-Encoding: chunked\r\n"+
+			"Connection: close\r\n"+
+			"\r\n%s",
+		reqPath,
+		*edgeHost,
+		len(smuggledBody),
+		smuggledBody,
+	)
+
+	resp := RawRoundTripCheckError(t, rawReq)
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest {
+		t.Log("Edge rejected request with both Content-Length and Transfer-Encoding")
+	}
+
+	if count := originServer.RequestCountForPath(reqPath); count > 1 {
+		t.Errorf("Origin received %d requests, expected at most 1", count)
+	}
+	if count := originServer.RequestCountForPath(smuggledPath); count != 0 {
+		t.Errorf("Origin received %d smuggled requests for %q", count, smuggledPath)
+	}
+}
+
+// Should only treat the number of bytes given by `Content-Length` as the
+// body of a response from origin. Origin sends more bytes than it declares,
+// and the excess is a complete second response. Origin keeps the connection
+// open afterwards, so that if edge reuses it, the smuggled response is what
+// it reads for the next request. Neither the client that made the request
+// nor the clients of subsequent requests should ever see it.
+func TestSecurityOriginContentLengthTooSmall(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const declaredBody = "short"
+	const smuggledBody = "smuggled response"
+	const expectedBody = "clean response"
+	const subsequentRequests = 3
+
+	smuggledResp := fmt.Sprintf(
+		"HTTP/1.1 200 OK\r\nContent-Length: %d\r\nCache-Control: max-age=3600\r\n\r\n%s",
+		len(smuggledBody),
+		smuggledBody,
+	)
+
+	rawHandler := rawResponseKeepOpenHandler(t, []byte(fmt.Sprintf(
+		"HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s%s",
+		len(declaredBody),
+		declaredBody,
+		smuggledResp,
+	)))
+
+	req := NewUniqueEdgeGET(t)
+	reqPath := req.URL.RequestURI()
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RequestURI() != reqPath {
+			w.Write([]byte(expectedBody))
+			return
+		}
+
+		rawHandler(w, r)
+	})
+
+	resp, err := client.RoundTrip(req)
+	if err == nil {
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if bodyStr := string(body); strings.Contains(bodyStr, smuggledBody) {
+			t.Errorf(
+				"Request received body beyond origin's Content-Length. Expected at most %q, got %q",
+				declaredBody,
+				bodyStr,
+			)
+		}
+	}
+
+	for requestCount := 1; requestCount <= subsequentRequests; requestCount++ {
+		req := NewUniqueEdgeGET(t)
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Subsequent request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
+// Should treat a lowercase `purge` method as an unknown method, because
+// methods are case-sensitive, rather than as a privileged PURGE. It should be
+// rejected as a bad or unsupported request, not forbidden as a PURGE would
+// be, and the cached object must not be purged. http.Request uppercases
+// known methods, so the request is sent raw.
+func TestSecurityMethodCaseSensitive(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cachedBody = "this should not be purged"
+	const reqMethod = "purge"
+
+	req := NewUniqueEdgeGET(t)
+	reqPath := req.URL.RequestURI()
+
+	resp := populateCache(t, req, cachedBody, nil)
+	defer resp.Body.Close()
+
+	for _, backend := range backendsByPriority {
+		backend.ExpectNoRequests(t)
+	}
+
+	rawReq := fmt.Sprintf(
+		"%s %s HTTP/1.1\r\n"+
+			"Host: %s\r\n"+
+			"Connection: close\r\n"+
+			"\r\n",
+		reqMethod,
+		reqPath,
+		*edgeHost,
+	)
+
+	resp = RawRoundTripCheckError(t, rawReq)
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusBadRequest,
+		http.StatusMethodNotAllowed,
+		http.StatusNotImplemented:
+		t.Logf("Edge rejected %q method with %q", reqMethod, resp.Status)
+	case http.StatusForbidden:
+		t.Errorf("Edge treated %q method as PURGE and responded %q", reqMethod, resp.Status)
+	default:
+		t.Errorf("Request with %q method received unexpected status %q", reqMethod, resp.Status)
+	}
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != cachedBody {
+		t.Errorf(
+			"Request after %q received incorrect response body. Expected %q, got %q",
+			reqMethod,
+			cachedBody,
+			bodyStr,
+		)
+	}
+}
+
+// Should not serve or cache a corrupted body when origin sends a gzip
+// compressed response with the wrong `Content-Length`. Edge may reject the
+// response or serve it with the body truncated to the declared length,
+// which the client will fail to decompress, but it must not present a
+// corrupted body as complete and valid or serve it from cache afterwards.
+func TestSecurityOriginGzipWrongContentLength(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "compressed with the wrong Content-Length"
+
+	restoreCompression := disableClientCompression()
+	defer restoreCompression()
+
+	gzbuf := new(bytes.Buffer)
+	gzwriter := gzip.NewWriter(gzbuf)
+	gzwriter.Write([]byte(expectedBody))
+	gzwriter.Close()
+	gzBody := gzbuf.Bytes()
+
+	contentLengths := map[string]int{
+		"too small": len(gzBody) / 2,
+		"too large": len(gzBody) * 2,
+	}
+
+	for name, contentLength := range contentLengths {
+		rawResp := fmt.Sprintf(
+			"HTTP/1.1 200 OK\r\n"+
+				"Cache-Control: max-age=3600\r\n"+
+				"Content-Encoding: gzip\r\n"+
+				"Content-Length: %d\r\n"+
+				"Vary: Accept-Encoding\r\n"+
+				"\r\n%s",
+			contentLength,
+			gzBody,
+		)
+		originServer.SwitchHandler(rawResponseHandler(t, []byte(rawResp)))
+
+		req := NewUniqueEdgeGET(t)
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		// Gzip's length and CRC trailer mean that a corrupted body will
+		// almost always fail to decompress, so this check is unlikely to
+		// fail. The request that follows, which checks that the corrupted
+		// response wasn't cached, is the main assertion of this test.
+		if resp, err := client.RoundTrip(req); err == nil {
+			defer resp.Body.Close()
+
+			body, err := readGzipBody(resp)
+			if err == nil && resp.StatusCode == http.StatusOK && body != expectedBody {
+				t.Errorf(
+					"Request with Content-Length %s received corrupted response body. Expected %q, got %q",
+					name,
+					expectedBody,
+					body,
+				)
+			}
+		}
+
+		originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Vary", "Accept-Encoding")
+			w.Write(gzBody)
+		})
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := readGzipBody(resp)
+		if err != nil {
+			t.Fatalf("Request after Content-Length %s received invalid gzip body: %s", name, err)
+		}
+		if body != expectedBody {
+			t.Errorf(
+				"Request after Content-Length %s received incorrect response body. Expected %q, got %q",
+				name,
+				expectedBody,
+				body,
+			)
+		}
+	}
+}
+
+// readGzipBody reads and decompresses the body of a response, which will
+// be an error if it isn't complete and valid gzip.
+func readGzipBody(resp *http.Response) (string, error) {
+	gzreader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	defer gzreader.Close()
+
+	body, err := ioutil.ReadAll(gzreader)
+	return string(body), err
+}
+
+// Should respond with a controlled client error, such as a 404 or 421, to
+// a request for a `Host` that isn't configured on edge, rather than serving
+// another tenant's content or passing it to our origin. The connection is
+// still made to edge, with our hostname for TLS.
+func TestSecurityUnknownHost(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const unknownHost = "cdn-acceptance-tests.invalid"
+
+	for _, backend := range backendsByPriority {
+		backend.ExpectNoRequests(t)
+	}
+
+	req := NewUniqueEdgeGET(t)
+	req.Host = unknownHost
+
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusBadRequest,
+		http.StatusForbidden,
+		http.StatusNotFound,
+		http.StatusMisdirectedRequest:
+		t.Logf("Edge rejected request for unknown host with %q", resp.Status)
+	default:
+		t.Errorf("Request for unknown host %q received unexpected status %q", unknownHost, resp.Status)
+	}
+}
+
+// Should reject `TRACE` and `CONNECT` requests with a controlled response,
+// rather than forwarding them to origin, reflecting the request back to the
+// client, which can expose headers such as cookies, or opening a tunnel.
+// http.Request won't send these methods as given, so the requests are sent
+// raw. The statuses that are expected depend on the vendor.
+func TestSecurityTRACEAndCONNECTRejected(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const headerName = "Trace-Test"
+	const tunnelTarget = "www.example.com:443"
+	var expectedStatuses []int
+
+	switch {
+	case vendorCloudflare:
+		expectedStatuses = []int{
+			http.StatusBadRequest,
+			http.StatusForbidden,
+			http.StatusMethodNotAllowed,
+			http.StatusNotImplemented,
+		}
+	case vendorFastly:
+		expectedStatuses = []int{
+			http.StatusBadRequest,
+			http.StatusMethodNotAllowed,
+			http.StatusNotImplemented,
+		}
+	default:
+		t.Fatal(notImplementedForVendor)
+	}
+
+	for _, backend := range backendsByPriority {
+		backend.ExpectNoRequests(t)
+	}
+
+	req := NewUniqueEdgeGET(t)
+	headerVal := NewUUID()
+
+	rawReqs := map[string]string{
+		"TRACE": fmt.Sprintf(
+			"TRACE %s HTTP/1.1\r\n"+
+				"Host: %s\r\n"+
+				"%s: %s\r\n"+
+				"Connection: close\r\n"+
+				"\r\n",
+			req.URL.RequestURI(),
+			*edgeHost,
+			headerName,
+			headerVal,
+		),
+		"CONNECT": fmt.Sprintf(
+			"CONNECT %s HTTP/1.1\r\n"+
+				"Host: %s\r\n"+
+				"%s: %s\r\n"+
+				"Connection: close\r\n"+
+				"\r\n",
+			tunnelTarget,
+			tunnelTarget,
+			headerName,
+			headerVal,
+		),
+	}
+
+	for method, rawReq := range rawReqs {
+		resp := RawRoundTripCheckError(t, rawReq)
+		defer resp.Body.Close()
+
+		expected := false
+		for _, status := range expectedStatuses {
+			if resp.StatusCode == status {
+				expected = true
+			}
+		}
+		if !expected {
+			t.Errorf(
+				"Request with %q method received unexpected status. Expected one of %v, got %q",
+				method,
+				expectedStatuses,
+				resp.Status,
+			)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(body), headerVal) {
+			t.Errorf("Request with %q method was reflected back to the client", method)
+		}
+	}
+}
+
+// Should reject a request whose lines are terminated by a bare LF, rather
+// than CRLF, instead of parsing it leniently. Disagreement between edge and
+// origin about where lines end can be used to smuggle requests. Go's client
+// always sends CRLF, so the request is sent raw.
+func TestSecurityBareLFRejected(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedStatus = http.StatusBadRequest
+
+	for _, backend := range backendsByPriority {
+		backend.ExpectNoRequests(t)
+	}
+
+	req := NewUniqueEdgeGET(t)
+	rawReq := fmt.Sprintf(
+		"GET %s HTTP/1.1\n"+
+			"Host: %s\n"+
+			"Connection: close\n"+
+			"\n",
+		req.URL.RequestURI(),
+		*edgeHost,
+	)
+
+	resp := RawRoundTripCheckError(t, rawReq)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		t.Errorf(
+			"Request with bare LF line endings received incorrect status code. Expected %d, got %d",
+			expectedStatus,
+			resp.StatusCode,
+		)
+	}
+}
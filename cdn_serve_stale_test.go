@@ -9,7 +9,9 @@ import (
 )
 
 // Should serve stale object and not hit any other backends, if origin
-// is down and object is beyond TTL but still in cache.
+// is down and object is beyond TTL but still in cache. With
+// -staleCacheStatus, the cache status should distinguish the stale object
+// from a normal hit.
 func TestServeStaleOriginDown(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
@@ -43,6 +45,10 @@ func TestServeStaleOriginDown(t *testing.T) {
 		resp := RoundTripCheckError(t, req)
 		defer resp.Body.Close()
 
+		if requestCount > 1 {
+			assertStaleCacheStatus(t, resp, fmt.Sprintf("Request %d", requestCount))
+		}
+
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			t.Fatal(err)
@@ -59,7 +65,9 @@ func TestServeStaleOriginDown(t *testing.T) {
 }
 
 // Should serve stale object and not hit any other backends, if origin
-// returns a 5xx response and object is beyond TTL but still in cache.
+// returns a 5xx response and object is beyond TTL but still in cache. With
+// -staleCacheStatus, the cache status should distinguish the stale object
+// from a normal hit.
 func TestServeStaleOrigin5xx(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
@@ -112,6 +120,88 @@ func TestServeStaleOrigin5xx(t *testing.T) {
 		resp := RoundTripCheckError(t, req)
 		defer resp.Body.Close()
 
+		if requestCount > 1 && requestCount < 5 {
+			assertStaleCacheStatus(t, resp, fmt.Sprintf("Request %d", requestCount))
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedBody {
+			t.Errorf(
+				"Request %d received incorrect response body. Expected %q, got %q",
+				requestCount,
+				expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
+// Should serve origin's own 5xx response, rather than a stale object, if
+// origin returns a 5xx response with a No-Fallback header and the object is
+// beyond TTL but still in cache. No-Fallback takes precedence over serving
+// stale so that applications can present their own error pages, in the
+// same way that it takes precedence over failing over to mirrors.
+func TestServeStaleOrigin5xxNoFallback(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedResponseStale = "going off like stilton"
+	const expectedResponseError = "custom error page"
+	const headerName = "No-Fallback"
+
+	const respTTL = time.Duration(2 * time.Second)
+	const respTTLWithBuffer = 5 * respTTL
+	headerValue := fmt.Sprintf("max-age=%.0f", respTTL.Seconds())
+
+	// All backends except origin.
+	for _, backend := range backendsByPriority[1:] {
+		backend := backend
+		backend.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("Server %s received request and it shouldn't have", backend.Name)
+			w.Write([]byte(backend.Name))
+		})
+	}
+
+	req := NewUniqueEdgeGET(t)
+
+	var expectedBody string
+	var expectedStatus int
+	for requestCount := 1; requestCount < 3; requestCount++ {
+		switch requestCount {
+		case 1: // Request 1 populates cache.
+			expectedBody = expectedResponseStale
+			expectedStatus = http.StatusOK
+
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", headerValue)
+				w.Write([]byte(expectedBody))
+			})
+		case 2: // Request 2 gets origin's error page instead of stale.
+			time.Sleep(respTTLWithBuffer)
+			expectedBody = expectedResponseError
+			expectedStatus = http.StatusServiceUnavailable
+
+			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(headerName, "")
+				w.WriteHeader(expectedStatus)
+				w.Write([]byte(expectedBody))
+			})
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != expectedStatus {
+			t.Errorf(
+				"Request %d received incorrect status code. Expected %d, got %d",
+				requestCount,
+				expectedStatus,
+				resp.StatusCode,
+			)
+		}
+
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			t.Fatal(err)
@@ -126,3 +216,171 @@ func TestServeStaleOrigin5xx(t *testing.T) {
 		}
 	}
 }
+
+// Should serve a stale object to all of several concurrent requests while
+// a single request revalidates it with a slow origin, and then serve the
+// refreshed object. This assumes that the edge revalidates in the
+// background, as permitted by the `stale-while-revalidate` directive.
+func TestServeStaleDuringRevalidation(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedResponseStale = "going off like stilton"
+	const expectedResponseFresh = "as fresh as daisies"
+	const concurrentRequests = 5
+
+	const respTTL = time.Duration(2 * time.Second)
+	const respTTLWithBuffer = 5 * respTTL
+	const originDelay = time.Duration(3 * time.Second)
+	const originDelayWithBuffer = 2 * originDelay
+	headerValue := fmt.Sprintf(
+		"max-age=%.0f, stale-while-revalidate=%.0f",
+		respTTL.Seconds(),
+		respTTLWithBuffer.Seconds()*2,
+	)
+
+	// All backends except origin.
+	for _, backend := range backendsByPriority[1:] {
+		backend.ExpectNoRequests(t)
+	}
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", headerValue)
+		w.Write([]byte(expectedResponseStale))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	time.Sleep(respTTLWithBuffer)
+
+	originServer.ResponseDelay = originDelay
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", headerValue)
+		w.Write([]byte(expectedResponseFresh))
+	})
+
+	requestsBefore := originServer.RequestCount()
+
+	for count, resp := range RoundTripConcurrently(t, req, concurrentRequests) {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != expectedResponseStale {
+			t.Errorf(
+				"Concurrent request %d received incorrect response body. Expected %q, got %q",
+				count+1,
+				expectedResponseStale,
+				bodyStr,
+			)
+		}
+	}
+
+	// Allow the revalidation to complete.
+	time.Sleep(originDelayWithBuffer)
+
+	if count := originServer.RequestCount() - requestsBefore; count != 1 {
+		t.Errorf("Origin received wrong number of revalidation requests. Expected 1, got %d", count)
+	}
+
+	originServer.ExpectNoRequests(t)
+
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bodyStr := string(body); bodyStr != expectedResponseFresh {
+		t.Errorf(
+			"Request after revalidation received incorrect response body. Expected %q, got %q",
+			expectedResponseFresh,
+			bodyStr,
+		)
+	}
+}
+
+// Should serve the last good object from stale each time origin starts
+// returning 5xx responses, when origin flaps between serving cacheable
+// responses and errors, rather than passing on any of the errors. Each
+// cycle expires the object and then serves several requests while origin is
+// erroring. Which requests reached origin is logged, because edge may back
+// off from origin during errors.
+func TestServeStaleOriginFlapping(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const cycles = 3
+	const requestsPerCycle = 3
+
+	const respTTL = time.Duration(2 * time.Second)
+	const respTTLWithBuffer = 5 * respTTL
+	// Allow varnish's beresp.saintmode to expire.
+	const waitSaintMode = time.Duration(5 * time.Second)
+	headerValue := fmt.Sprintf("max-age=%.0f", respTTL.Seconds())
+
+	// All backends except origin.
+	for _, backend := range backendsByPriority[1:] {
+		backend.ExpectNoRequests(t)
+	}
+
+	req := NewUniqueEdgeGET(t)
+	reqPath := req.URL.RequestURI()
+
+	for cycle := 1; cycle <= cycles; cycle++ {
+		expectedBody := fmt.Sprintf("good response %d", cycle)
+		var reachedOrigin []bool
+
+		for requestCount := 1; requestCount <= requestsPerCycle; requestCount++ {
+			switch requestCount {
+			case 1: // Request 1 gets a new object from origin.
+				if cycle > 1 {
+					time.Sleep(waitSaintMode)
+				}
+
+				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Cache-Control", headerValue)
+					w.Write([]byte(expectedBody))
+				})
+			case 2: // Remaining requests come from stale.
+				time.Sleep(respTTLWithBuffer)
+
+				originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					w.Write([]byte(originServer.Name))
+				})
+			}
+
+			requestsBefore := originServer.RequestCountForPath(reqPath)
+
+			resp := RoundTripCheckError(t, req)
+			defer resp.Body.Close()
+
+			reachedOrigin = append(reachedOrigin, originServer.RequestCountForPath(reqPath) > requestsBefore)
+
+			if requestCount > 1 {
+				assertStaleCacheStatus(t, resp, fmt.Sprintf("Cycle %d request %d", cycle, requestCount))
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bodyStr := string(body); bodyStr != expectedBody {
+				t.Errorf(
+					"Cycle %d request %d received incorrect response body. Expected %q, got %q",
+					cycle,
+					requestCount,
+					expectedBody,
+					bodyStr,
+				)
+			}
+		}
+
+		if !reachedOrigin[0] {
+			t.Errorf("Cycle %d request 1 didn't reach origin for a new object", cycle)
+		}
+		t.Logf("Cycle %d requests that reached origin: %v", cycle, reachedOrigin)
+	}
+}
@@ -1,20 +1,29 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/rand"
+	"context"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	mathrand "math/rand"
 	"mime"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
 	"net/url"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -22,16 +31,39 @@ import (
 // CDNBackendServer is a backend server which will receive and respond to
 // requests from the CDN.
 type CDNBackendServer struct {
-	Name     string
-	Port     int
-	TLSCerts []tls.Certificate
-	handler  func(w http.ResponseWriter, r *http.Request)
-	server   *httptest.Server
+	Name          string
+	Port          int
+	TLSCerts      []tls.Certificate
+	ResponseDelay time.Duration
+	Record        bool
+	handler       func(w http.ResponseWriter, r *http.Request)
+	server        *httptest.Server
+	requestsMutex sync.Mutex
+	requestCounts map[string]int
+	transcript    []Exchange
+	lastProtocol  string
+}
+
+// Exchange is a request received by a CDNBackendServer and the response
+// that its handler produced, as recorded when Record is set. Hijacked is
+// set if the handler took over the connection, in which case StatusCode is
+// zero unless a response was started first, and anything written to the
+// connection directly isn't recorded.
+type Exchange struct {
+	Method         string
+	URL            string
+	RequestHeader  http.Header
+	RequestBody    []byte
+	StatusCode     int
+	ResponseHeader http.Header
+	ResponseBody   []byte
+	Hijacked       bool
 }
 
 // ServeHTTP satisfies the http.HandlerFunc interface. Health check requests
-// for `HEAD` are always served 200 responses. Other requests are passed
-// off to a custom handler provided by SwitchHandler.
+// for `HEAD` are always served 200 responses. Other requests are counted,
+// delayed by ResponseDelay, and passed off to a custom handler provided by
+// SwitchHandler. If Record is set, they are also added to the transcript.
 func (s *CDNBackendServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Backend-Name", s.Name)
 
@@ -41,13 +73,144 @@ func (s *CDNBackendServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.handler(w, r)
+	s.requestsMutex.Lock()
+	s.requestCounts[r.URL.RequestURI()]++
+	if r.TLS != nil {
+		s.lastProtocol = r.TLS.NegotiatedProtocol
+	}
+	s.requestsMutex.Unlock()
+
+	time.Sleep(s.ResponseDelay)
+
+	if !s.Record {
+		s.handler(w, r)
+		return
+	}
+
+	reqBody, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+
+	rw := &recordingResponseWriter{ResponseWriter: w}
+	s.handler(rw, r)
+
+	statusCode := rw.statusCode
+	if statusCode == 0 && !rw.hijacked {
+		statusCode = http.StatusOK
+	}
+
+	s.requestsMutex.Lock()
+	s.transcript = append(s.transcript, Exchange{
+		Method:         r.Method,
+		URL:            r.URL.RequestURI(),
+		RequestHeader:  r.Header.Clone(),
+		RequestBody:    reqBody,
+		StatusCode:     statusCode,
+		ResponseHeader: w.Header().Clone(),
+		ResponseBody:   rw.body.Bytes(),
+		Hijacked:       rw.hijacked,
+	})
+	s.requestsMutex.Unlock()
 }
 
 // ResetHandler sets the handler back to an empty function that will return
-// a 200 response.
+// a 200 response, and resets the request counts, transcript, last
+// negotiated protocol, ResponseDelay and Record.
 func (s *CDNBackendServer) ResetHandler() {
 	s.handler = func(w http.ResponseWriter, r *http.Request) {}
+	s.ResponseDelay = 0
+	s.Record = false
+
+	s.requestsMutex.Lock()
+	s.requestCounts = make(map[string]int)
+	s.transcript = nil
+	s.lastProtocol = ""
+	s.requestsMutex.Unlock()
+}
+
+// LastNegotiatedProtocol returns the ALPN protocol that was negotiated for
+// the connection of the most recent request, excluding health checks,
+// since the handler was last reset. It's empty if the client didn't use
+// ALPN. The server only offers `http/1.1`, so that is the only protocol that
+// can be negotiated.
+func (s *CDNBackendServer) LastNegotiatedProtocol() string {
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	return s.lastProtocol
+}
+
+// Transcript returns the requests, excluding health checks, and responses
+// that have been recorded, in the order that they completed, since the
+// handler was last reset.
+func (s *CDNBackendServer) Transcript() []Exchange {
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	return append([]Exchange(nil), s.transcript...)
+}
+
+// recordingResponseWriter wraps a http.ResponseWriter to keep a copy of the
+// status code and body written by a handler. It passes through Flush and
+// Hijack so that handlers which need them still work when recorded.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+	hijacked   bool
+}
+
+func (rw *recordingResponseWriter) WriteHeader(statusCode int) {
+	if rw.statusCode == 0 {
+		rw.statusCode = statusCode
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rw.statusCode == 0 {
+		rw.statusCode = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingResponseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, bufrw, err := rw.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		rw.hijacked = true
+	}
+	return conn, bufrw, err
+}
+
+// RequestCountForPath returns the number of requests, excluding health
+// checks, that have been received for a path since the handler was last
+// reset. The path must include any query string, as returned by
+// `URL.RequestURI()`.
+func (s *CDNBackendServer) RequestCountForPath(path string) int {
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	return s.requestCounts[path]
+}
+
+// RequestCount returns the number of requests, excluding health checks, that
+// have been received for all paths since the handler was last reset.
+func (s *CDNBackendServer) RequestCount() int {
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	total := 0
+	for _, count := range s.requestCounts {
+		total += count
+	}
+
+	return total
 }
 
 // SwitchHandler sets the handler to a custom function. This is used by
@@ -56,6 +219,111 @@ func (s *CDNBackendServer) SwitchHandler(h func(w http.ResponseWriter, r *http.R
 	s.handler = h
 }
 
+// ServeFixtures sets the handler to serve files from a directory, mapping
+// the request path to a file beneath it. The `Content-Type` is set according
+// to the file's extension. Requests for files that don't exist are served
+// 404 responses.
+func (s *CDNBackendServer) ServeFixtures(dir string) {
+	s.handler = func(w http.ResponseWriter, r *http.Request) {
+		fixtureFile := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		fixtureData, err := ioutil.ReadFile(fixtureFile)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if contentType := mime.TypeByExtension(filepath.Ext(fixtureFile)); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Write(fixtureData)
+	}
+}
+
+// ExpectNoRequests sets the handler to a function that fails the calling
+// test if the server receives any requests other than health checks.
+func (s *CDNBackendServer) ExpectNoRequests(t *testing.T) {
+	s.handler = func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Server %s received request and it shouldn't have", s.Name)
+		w.Write([]byte(s.Name))
+	}
+}
+
+// abortAfterHandler returns a handler that declares a `Content-Length` for
+// the whole of body, writes only the first cutAt bytes of it, and then
+// closes the underlying connection. This simulates origin failing part way
+// through a response, which handlers that return normally can't do.
+func abortAfterHandler(body []byte, cutAt int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body[:cutAt])
+		w.(http.Flusher).Flush()
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			log.Printf("Unable to hijack connection to abort response: %s", err)
+			return
+		}
+		conn.Close()
+	}
+}
+
+// rawResponseHandler returns a handler that writes the given bytes directly
+// to the underlying connection, and then closes it, in place of a response.
+// This allows origin to send responses that http.ResponseWriter would
+// prevent, such as a body that doesn't match its `Content-Length`. Errors
+// hijacking the connection are reported to t.
+func rawResponseHandler(t *testing.T, rawResp []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Unable to hijack connection to origin: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		bufrw.Write(rawResp)
+		bufrw.Flush()
+	}
+}
+
+// rawResponseKeepOpenHandler returns a handler like rawResponseHandler, but
+// which leaves the connection open afterwards, discarding anything sent on
+// it until it's closed by the other end or requestTimeout passes. This
+// allows bytes beyond the end of a response to be read as the response to
+// the next request on the same connection.
+func rawResponseKeepOpenHandler(t *testing.T, rawResp []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Unable to hijack connection to origin: %s", err)
+			return
+		}
+		defer conn.Close()
+
+		bufrw.Write(rawResp)
+		bufrw.Flush()
+
+		conn.SetReadDeadline(time.Now().Add(requestTimeout))
+		io.Copy(ioutil.Discard, conn)
+	}
+}
+
+// clientIPHandler returns a handler that serves the address of the client
+// as its body, as reported by edge in the `True-Client-IP` header or, if
+// that is missing, the last address in `X-Forwarded-For`. This simulates an
+// origin that serves different content by location.
+func clientIPHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientIP := r.Header.Get("True-Client-IP")
+		if clientIP == "" {
+			xffVals := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+			clientIP = strings.TrimSpace(xffVals[len(xffVals)-1])
+		}
+
+		w.Write([]byte(clientIP))
+	}
+}
+
 // IsStarted checks whether the server is currently started.
 func (s *CDNBackendServer) IsStarted() bool {
 	return (s.server != nil)
@@ -100,62 +368,191 @@ func (s *CDNBackendServer) Start() {
 	log.Printf("Started server on port %d", s.Port)
 }
 
+// LatencyRecorder records the durations of requests so that percentiles can
+// be reported at the end of a test run. It is safe for concurrent use.
+type LatencyRecorder struct {
+	durations []time.Duration
+	mutex     sync.Mutex
+}
+
+// Record adds the duration of a single request.
+func (l *LatencyRecorder) Record(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.durations = append(l.durations, d)
+}
+
+// Count returns the number of durations recorded.
+func (l *LatencyRecorder) Count() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.durations)
+}
+
+// Percentile returns the duration at percentile p, between 0 and 100, of
+// those recorded using the nearest-rank method. It returns zero if nothing
+// has been recorded.
+func (l *LatencyRecorder) Percentile(p float64) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.durations) == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, len(l.durations))
+	copy(sorted, l.durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
 // CachedHostLookup caches DNS lookups for the given `Host` in order to
-// prevent us switching to another edge location in the middle of tests.
+// prevent us switching to another edge location in the middle of tests. If
+// `Network` is set, such as "tcp6", then it will be used for all connections
+// to `Host` and only addresses of that family will be considered. If `IP` is
+// set then it will be used without performing any DNS lookups. It is safe
+// for concurrent use once created.
 type CachedHostLookup struct {
-	Host         string
-	hardCachedIP string
+	Host       string
+	Network    string
+	IP         string
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	mutex      sync.Mutex
 }
 
-// lookup performs a DNS lookup and caches the first IP address returned.
-// Subsequent requests always return the cached address, preventing further
-// DNS requests.
-func (c *CachedHostLookup) lookup(host string) string {
-	if c.hardCachedIP == "" {
-		ipAddresses, err := net.LookupHost(host)
+// lookup performs a DNS lookup and caches the first IP address returned
+// that is suitable for `Network`. Subsequent requests always return the
+// cached address, preventing further DNS requests. Concurrent requests wait
+// for the first lookup to complete.
+func (c *CachedHostLookup) lookup(ctx context.Context, host string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.IP == "" {
+		lookupHost := c.lookupHost
+		if lookupHost == nil {
+			lookupHost = net.DefaultResolver.LookupHost
+		}
+
+		ipAddresses, err := lookupHost(ctx, host)
 		if err != nil {
-			log.Fatal(err)
+			return "", err
 		}
 
-		c.hardCachedIP = ipAddresses[0]
+		for _, ipAddress := range ipAddresses {
+			isIPv4 := net.ParseIP(ipAddress).To4() != nil
+			if (c.Network == "tcp4" && !isIPv4) || (c.Network == "tcp6" && isIPv4) {
+				continue
+			}
+
+			c.IP = ipAddress
+			break
+		}
+
+		if c.IP == "" {
+			return "", fmt.Errorf("no %s addresses found for %s", c.Network, host)
+		}
 	}
 
-	return c.hardCachedIP
+	return c.IP, nil
 }
 
-// Dial acts as a wrapper for `net.Dial`, ostensibly for use with
-// `http.Transport`. If the hostname matches `Host` then it will use the
-// cached address.
-func (c *CachedHostLookup) Dial(network, addr string) (net.Conn, error) {
+// DialContext acts as a wrapper for `net.Dialer.DialContext`, ostensibly for
+// use with `http.Transport`. If the hostname matches `Host` then it will use
+// the cached address.
+func (c *CachedHostLookup) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	if host != c.Host {
-		return net.Dial(network, addr)
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	if c.Network != "" {
+		network = c.Network
+	}
+
+	ipAddr, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ipAddr, port))
+}
+
+// Dial is the same as DialContext without a context.
+func (c *CachedHostLookup) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// NewCachedDialHosts returns a `DialContext` function that uses the cached
+// address for each of the given CachedHostLookup objects when dialling its
+// `Host`. Any other hostname is dialled without caching. This allows a
+// single `http.Transport` to pin more than one host.
+func NewCachedDialHosts(lookups ...*CachedHostLookup) func(context.Context, string, string) (net.Conn, error) {
+	lookupsByHost := make(map[string]*CachedHostLookup, len(lookups))
+	for _, c := range lookups {
+		lookupsByHost[c.Host] = c
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if c, ok := lookupsByHost[host]; ok {
+			return c.DialContext(ctx, network, addr)
+		}
+
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
 	}
+}
 
-	ipAddr := c.lookup(host)
-	return net.Dial(network, net.JoinHostPort(ipAddr, port))
+// seededReader is a source of pseudo-random bytes from a seeded generator,
+// so that the same sequence of UUIDs can be reproduced by using the same
+// seed. It is safe for concurrent use and every read continues the
+// sequence, so concurrent callers never receive the same bytes.
+type seededReader struct {
+	rand  *mathrand.Rand
+	mutex sync.Mutex
 }
 
-// NewCachedDial returns the `Dial` function for a new CachedHostLookup
-// object with the given host.
-func NewCachedDial(host string) func(string, string) (net.Conn, error) {
-	c := CachedHostLookup{
-		Host: host,
+// newSeededReader returns a seededReader for the given seed.
+func newSeededReader(seed int64) *seededReader {
+	return &seededReader{
+		rand: mathrand.New(mathrand.NewSource(seed)),
 	}
+}
+
+// Read satisfies the io.Reader interface. It never returns an error.
+func (r *seededReader) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	return c.Dial
+	return r.rand.Read(p)
 }
 
-// NewUUID returns a v4 (random) UUID string.
+// NewUUID returns a v4 (random) UUID string. The random bytes are read
+// from uuidReader, which is seeded by -seed for reproducible runs.
 // This might not be strictly RFC4122 compliant, but it will do. Credit:
 // https://groups.google.com/d/msg/golang-nuts/Rn13T6BZpgE/dBaYVJ4hB5gJ
 func NewUUID() string {
 	bs := make([]byte, 16)
-	rand.Read(bs)
+	io.ReadFull(uuidReader, bs)
 	bs[6] = (bs[6] & 0x0f) | 0x40
 	bs[8] = (bs[8] & 0x3f) | 0x80
 
@@ -179,13 +576,12 @@ func NewUniqueEdgeURL() string {
 	return url.String()
 }
 
-// NewUniqueEdgeGET constructs a GET request (but not perform it) against edge.
-// Uses NewUniqueEdgeURL() to ensure that it hasn't previously been cached. The
-// request method field of the returned object can be later modified if
-// required.
-func NewUniqueEdgeGET(t *testing.T) *http.Request {
+// NewUniqueEdgeRequest constructs a request (but not perform it) against
+// edge with the given method and body, which may be nil. Uses
+// NewUniqueEdgeURL() to ensure that it hasn't previously been cached.
+func NewUniqueEdgeRequest(t *testing.T, method string, body io.Reader) *http.Request {
 	url := NewUniqueEdgeURL()
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -193,16 +589,196 @@ func NewUniqueEdgeGET(t *testing.T) *http.Request {
 	return req
 }
 
+// NewUniqueEdgeGET constructs a GET request (but not perform it) against edge.
+// Uses NewUniqueEdgeURL() to ensure that it hasn't previously been cached. The
+// request method field of the returned object can be later modified if
+// required.
+func NewUniqueEdgeGET(t *testing.T) *http.Request {
+	return NewUniqueEdgeRequest(t, "GET", nil)
+}
+
+// newTimingTrace returns a trace that logs the duration of the DNS,
+// connect, and TLS handshake phases of a request, and the time to the first
+// byte of the response. DNS lookups should only be logged for the first
+// connection to edge because they are cached by CachedHostLookup. They are
+// only logged here; TestMiscDNSLookupPinned fails if they aren't cached.
+func newTimingTrace(t *testing.T) *httptrace.ClientTrace {
+	var dnsStart, connectStart, tlsStart time.Time
+	start := time.Now()
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			t.Logf("DNS lookup took %s: %v", time.Since(dnsStart), info.Addrs)
+		},
+		ConnectStart: func(network, addr string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.Logf("Connect to %s took %s", addr, time.Since(connectStart))
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.Logf("TLS handshake took %s", time.Since(tlsStart))
+		},
+		GotFirstResponseByte: func() {
+			t.Logf("First response byte after %s", time.Since(start))
+		},
+	}
+}
+
 // RoundTripCheckError makes an HTTP request using http.RoundTrip, which
 // doesn't handle redirects or cookies, and return the response. If there are
 // any errors then the calling test will be aborted so as not to operate on a
 // nil response.
 func RoundTripCheckError(t *testing.T, req *http.Request) *http.Response {
+	resp, _ := RoundTripTimed(t, req)
+	return resp
+}
+
+// RoundTripTimed behaves like RoundTripCheckError and also returns how long
+// it took to receive the response headers.
+func RoundTripTimed(t *testing.T, req *http.Request) (*http.Response, time.Duration) {
+	if *debugConnReuse {
+		connTrace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				t.Logf("Connection to %s reused: %t", info.Conn.RemoteAddr(), info.Reused)
+			},
+		}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), connTrace))
+	}
+	if *traceTimings {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), newTimingTrace(t)))
+	}
+
 	start := time.Now()
 	resp, err := client.RoundTrip(req)
-	if duration := time.Since(start); duration > requestSlowThreshold {
+	duration := time.Since(start)
+	if duration > requestSlowThreshold {
 		t.Error("Slow request, took:", duration)
 	}
+	if *latencyReport {
+		latencies.Record(duration)
+	}
+	if *debugResp {
+		t.Logf("%#v", resp)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, duration
+}
+
+// disableClientCompression tells the transport not to add `Accept-Encoding`
+// headers and automatically decompress responses, so that a test can see
+// exactly what edge serves. It returns a function that restores the
+// previous setting, which should be deferred by the caller.
+func disableClientCompression() func() {
+	origClientDisableCompression := client.DisableCompression
+	client.DisableCompression = true
+
+	return func() {
+		client.DisableCompression = origClientDisableCompression
+	}
+}
+
+// PurgeEdge invalidates the edge's cached object for the URL of a request
+// by sending a PURGE for it. This only works when running from an address
+// that is whitelisted for purging, as given by -purgeWhitelisted. If the
+// purge isn't accepted then the calling test will be aborted.
+func PurgeEdge(t *testing.T, req *http.Request) {
+	purgeReq := req.Clone(req.Context())
+	purgeReq.Method = "PURGE"
+
+	resp := RoundTripCheckError(t, purgeReq)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PURGE for %q received incorrect status %q", req.URL.RequestURI(), resp.Status)
+	}
+}
+
+// RoundTripConcurrently makes the same request to edge from several
+// goroutines at once using http.RoundTrip and returns the responses, in no
+// particular order, with their bodies already read. The request must not
+// have a body. If there are any errors then the calling test will be aborted
+// once all of the requests have completed.
+func RoundTripConcurrently(t *testing.T, req *http.Request, count int) []*http.Response {
+	var wg sync.WaitGroup
+	responses := make([]*http.Response, count)
+	errs := make([]error, count)
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			resp, err := client.RoundTrip(req.Clone(req.Context()))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer resp.Body.Close()
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+			responses[i] = resp
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return responses
+}
+
+// DialEdgeTLS opens a new TLS connection to edge, dialled in the same way as
+// client, with a deadline of requestTimeout. It's for tests that need to
+// write raw requests or observe the connection itself. If there are any
+// errors then the calling test will be aborted.
+func DialEdgeTLS(t *testing.T) *tls.Conn {
+	conn, err := client.DialContext(context.Background(), "tcp", net.JoinHostPort(*edgeHost, "443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig := client.TLSClientConfig.Clone()
+	tlsConfig.ServerName = *edgeHost
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(requestTimeout))
+
+	return tlsConn
+}
+
+// RawRoundTripCheckError writes a raw HTTP request to edge over a new TLS
+// connection, dialled in the same way as client, and returns the response.
+// This is for requests that http.Request won't construct, such as those
+// with conflicting headers or malformed request lines, so it should include
+// `Connection: close`. The response body is read in full before the
+// connection is closed. If there are any errors then the calling test will
+// be aborted so as not to operate on a nil response.
+func RawRoundTripCheckError(t *testing.T, rawReq string) *http.Response {
+	tlsConn := DialEdgeTLS(t)
+	defer tlsConn.Close()
+
+	if _, err := io.WriteString(tlsConn, rawReq); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
 	if *debugResp {
 		t.Logf("%#v", resp)
 	}
@@ -210,13 +786,118 @@ func RoundTripCheckError(t *testing.T, req *http.Request) *http.Response {
 		t.Fatal(err)
 	}
 
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
 	return resp
 }
 
+// RoundTripBothFamilies makes the same request to edge over both IPv4 and
+// IPv6 using http.RoundTrip and returns both responses, so that tests can
+// compare them. The request must not have a body because it will be sent
+// twice. The response for an address family that we're unable to connect
+// over will be nil. If neither is reachable then the calling test will be
+// aborted.
+func RoundTripBothFamilies(t *testing.T, req *http.Request) (ipv4Resp, ipv6Resp *http.Response) {
+	families := []struct {
+		name   string
+		client *http.Transport
+		resp   **http.Response
+	}{
+		{"IPv4", clientIPv4, &ipv4Resp},
+		{"IPv6", clientIPv6, &ipv6Resp},
+	}
+
+	for _, family := range families {
+		familyReq := *req
+		familyReq.Header = make(http.Header, len(req.Header))
+		for name, vals := range req.Header {
+			familyReq.Header[name] = append([]string(nil), vals...)
+		}
+
+		resp, err := family.client.RoundTrip(&familyReq)
+		if err != nil {
+			t.Logf("Unable to make request over %s: %s", family.name, err)
+			continue
+		}
+		if *debugResp {
+			t.Logf("%s: %#v", family.name, resp)
+		}
+
+		*family.resp = resp
+	}
+
+	if ipv4Resp == nil && ipv6Resp == nil {
+		t.Fatal("Unable to make request over either IPv4 or IPv6")
+	}
+
+	return ipv4Resp, ipv6Resp
+}
+
+// assertCacheStatus fails the calling test if the cache status of a response
+// from edge doesn't match the expected status, which should be one of
+// "HIT", "MISS", "EXPIRED" or "STALE". The status is read from the vendor's
+// own header and normalised from vendor specific values, such as "Hit from
+// cloudfront" or "MISS, HIT" where the last value is that of the edge.
+// Stale objects are reported by Cloudflare as "STALE" or "UPDATING", and by
+// Fastly as "HIT-STALE" when the service adds `fastly_info.state` to
+// `X-Cache`, all of which are normalised to "STALE". The label identifies
+// the request in the failure, such as "Request 2".
+func assertCacheStatus(t *testing.T, resp *http.Response, expected string, label string) {
+	var headerName string
+
+	switch {
+	case vendorCloudflare:
+		headerName = "CF-Cache-Status"
+	case vendorFastly:
+		headerName = "X-Cache"
+	default:
+		t.Fatal(notImplementedForVendor)
+	}
+
+	headerVal := resp.Header.Get(headerName)
+	status := headerVal
+	if i := strings.LastIndex(status, ","); i >= 0 {
+		status = status[i+1:]
+	}
+	if fields := strings.Fields(status); len(fields) > 0 {
+		status = strings.ToUpper(fields[0])
+	}
+	switch status {
+	case "UPDATING", "HIT-STALE":
+		status = "STALE"
+	}
+
+	if status != expected {
+		t.Errorf(
+			"%s received incorrect cache status in %s header. Expected %q, got %q from %q",
+			label,
+			headerName,
+			expected,
+			status,
+			headerVal,
+		)
+	}
+}
+
+// assertStaleCacheStatus fails the calling test if the cache status of a
+// response from edge isn't "STALE", but only when -staleCacheStatus is set.
+// Edges that don't distinguish stale objects, such as a stock Fastly
+// service, report them as normal hits.
+func assertStaleCacheStatus(t *testing.T, resp *http.Response, label string) {
+	if *staleCacheStatus {
+		assertCacheStatus(t, resp, "STALE", label)
+	}
+}
+
 // ResetBackends resets all backends, ensuring that they are started, have the
 // default handler function, and that the edge considers them healthy. It may
 // take some time because we need to receive and respond to enough probe health
-// checks to be considered up.
+// checks to be considered up. A backend that doesn't become healthy will be
+// restarted up to -backendConvergeRetries times before the run is aborted.
 func ResetBackends(backends []*CDNBackendServer) {
 	remainingBackendsStopped := false
 
@@ -236,6 +917,18 @@ func ResetBackends(backends []*CDNBackendServer) {
 
 			backend.Start()
 			err := waitForBackend(backend.Name)
+			for retry := 1; err != nil && retry <= *backendConvergeRetries; retry++ {
+				log.Printf(
+					"Backend %s failed to converge, restarting (retry %d of %d): %s",
+					backend.Name,
+					retry,
+					*backendConvergeRetries,
+					err,
+				)
+				backend.Stop()
+				backend.Start()
+				err = waitForBackend(backend.Name)
+			}
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -243,6 +936,54 @@ func ResetBackends(backends []*CDNBackendServer) {
 	}
 }
 
+// repeatedly runs a test body n times, as subtests, resetting the backends
+// before each run. It stops at, and reports, the first iteration that fails
+// so that intermittent failures can be reproduced, such as with
+// -repeatBackOff. When n is one the body is run directly so that test names
+// are unchanged. The backends are also reset after each iteration, so that
+// no handler is left referring to a subtest that has completed.
+func repeatedly(t *testing.T, n int, fn func(t *testing.T)) {
+	if n <= 1 {
+		ResetBackends(backendsByPriority)
+		fn(t)
+		return
+	}
+
+	for iteration := 1; iteration <= n; iteration++ {
+		ResetBackends(backendsByPriority)
+		passed := t.Run(fmt.Sprintf("iteration-%d", iteration), fn)
+		ResetBackends(backendsByPriority)
+
+		if !passed {
+			t.Fatalf("Failed on iteration %d of %d", iteration, n)
+		}
+	}
+}
+
+// forEachBackendAsOrigin runs fn, as a subtest, once for each backend in
+// backendsByPriority. Before each run the higher priority backends are
+// stopped, so that the given backend is the one serving requests, and all
+// backends are restored afterwards. This allows a test to assert that edge
+// behaves the same regardless of which backend is serving.
+func forEachBackendAsOrigin(t *testing.T, fn func(t *testing.T, backend *CDNBackendServer)) {
+	defer ResetBackends(backendsByPriority)
+
+	for i, backend := range backendsByPriority {
+		ResetBackends(backendsByPriority)
+
+		if i > 0 {
+			stopBackends(backendsByPriority[:i])
+			if err := waitForBackend(backend.Name); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		t.Run(backend.Name, func(t *testing.T) {
+			fn(t, backend)
+		})
+	}
+}
+
 // Ensure that a slice of backends are stopped.
 func stopBackends(backends []*CDNBackendServer) {
 	for _, backend := range backends {
@@ -294,6 +1035,49 @@ func waitForBackend(expectedBackendName string) error {
 
 }
 
+// populateCache configures origin to respond with the given body and
+// headers, makes a single request to edge so that the response is cached,
+// and then configures origin to fail the calling test if it receives any
+// further requests. The response to the priming request is returned so
+// that it can be checked, and its body should be closed by the caller.
+// Callers that populate from a subtest should install their own guard
+// with the parent test once the subtest has completed.
+func populateCache(
+	t *testing.T,
+	req *http.Request,
+	body string,
+	headers http.Header,
+) *http.Response {
+	return populateCacheWithHandler(t, req, func(w http.ResponseWriter, r *http.Request) {
+		for name, vals := range headers {
+			for _, val := range vals {
+				w.Header().Add(name, val)
+			}
+		}
+		w.Write([]byte(body))
+	})
+}
+
+// populateCacheWithHandler is the same as populateCache but origin responds
+// to the priming request using handler, so that the response can be
+// derived from the request that edge sends.
+func populateCacheWithHandler(
+	t *testing.T,
+	req *http.Request,
+	handler http.HandlerFunc,
+) *http.Response {
+	originServer.SwitchHandler(handler)
+
+	resp := RoundTripCheckError(t, req)
+
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Request for %q should not have made it to origin", r.URL.RequestURI())
+		w.Write([]byte("not cached"))
+	})
+
+	return resp
+}
+
 // Callback function to modify complete response.
 type responseCallback func(w http.ResponseWriter)
 
@@ -433,13 +1217,14 @@ func testThreeRequestsNotCached(t *testing.T, req *http.Request, headerCB respon
 	}
 }
 
-// testResponseNotManipulated configures origin to respond to a request with
-// the contents of fixture file. It then makes a request and asserts that
+// testResponseNotManipulated configures origin to serve the fixture's
+// directory. It then makes a request for the fixture file and asserts that
 // the response body matches the original fixture file, meaning that the CDN
-// hasn't manipulated it in any way. The `Content-Type` and request path are
-// set according to the fixture's file extension to ensure that the CDN
-// detects it correctly.
-func testResponseNotManipulated(t *testing.T, fixtureFile string) {
+// hasn't manipulated it in any way. The `Content-Type` is set according to
+// the fixture's file extension to ensure that the CDN detects it correctly.
+// A responseCallback, if not nil, will be called to modify the response
+// before the fixture is written.
+func testResponseNotManipulated(t *testing.T, fixtureFile string, respCB responseCallback) {
 	fixtureData, err := ioutil.ReadFile(fixtureFile)
 	if err != nil {
 		t.Fatalf("Unable load fixture file %q", fixtureFile)
@@ -450,10 +1235,14 @@ func testResponseNotManipulated(t *testing.T, fixtureFile string) {
 		t.Fatalf("Unable to determine fixture Content-Type. Got %q", contentType)
 	}
 
-	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", contentType)
-		w.Write(fixtureData)
-	})
+	originServer.ServeFixtures(filepath.Dir(fixtureFile))
+	if respCB != nil {
+		serveFixture := originServer.handler
+		originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			respCB(w)
+			serveFixture(w, r)
+		})
+	}
 
 	req := NewUniqueEdgeGET(t)
 	req.URL.Path = "/" + filepath.Base(fixtureFile)
@@ -466,15 +1255,62 @@ func testResponseNotManipulated(t *testing.T, fixtureFile string) {
 		t.Fatal(err)
 	}
 
-	if !bytes.Equal(body, fixtureData) {
-		t.Error("Response body did not match fixture")
+	assertBodyEqual(t, body, fixtureData)
+}
 
-		if bytes.Compare(body, fixtureData) != 0 {
-			t.Errorf(
-				"Response body sizes for debug purposes. Expected %d, got %d",
-				len(fixtureData),
-				len(body),
-			)
+// firstDifference returns the offset of the first byte that differs between
+// a and b, or the length of the shorter if one is a prefix of the other. It
+// returns -1 if they are equal.
+func firstDifference(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return -1
+	}
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
 		}
 	}
+
+	if len(a) < len(b) {
+		return len(a)
+	}
+	return len(b)
+}
+
+// assertBodyEqual fails the calling test if a response body doesn't match
+// the expected bytes. To help diagnose subtle changes, such as an inserted
+// BOM or trailing newline, it logs the offset of the first difference and a
+// hex dump of both around that offset.
+func assertBodyEqual(t *testing.T, got, want []byte) {
+	const contextBytes = 16
+
+	offset := firstDifference(got, want)
+	if offset < 0 {
+		return
+	}
+
+	window := func(b []byte) []byte {
+		start := offset - contextBytes
+		if start < 0 {
+			start = 0
+		}
+		end := offset + contextBytes
+		if end > len(b) {
+			end = len(b)
+		}
+		if start > end {
+			start = end
+		}
+		return b[start:end]
+	}
+
+	t.Errorf(
+		"Response body did not match. Expected %d bytes, got %d, first difference at offset %d",
+		len(want),
+		len(got),
+		offset,
+	)
+	t.Logf("Expected bytes around offset %d:\n%s", offset, hex.Dump(window(want)))
+	t.Logf("Received bytes around offset %d:\n%s", offset, hex.Dump(window(got)))
 }
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // CDNBackendServer instance should be ready to serve requests when test
@@ -59,6 +68,505 @@ func TestHelpersCDNBackendServerProbes(t *testing.T) {
 	}
 }
 
+// CDNBackendServer should answer HEAD health checks immediately, even while
+// it is busy serving slow requests, so that the CDN doesn't consider it
+// unhealthy under load.
+func TestHelpersCDNBackendServerProbesUnderLoad(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const responseDelay = time.Duration(3 * time.Second)
+	const probeThreshold = time.Duration(500 * time.Millisecond)
+	const concurrentRequests = 5
+
+	originServer.ResponseDelay = responseDelay
+	url := originServer.server.URL + "/"
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for i := 0; i < concurrentRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, _ := http.NewRequest("GET", url+NewUUID(), nil)
+			resp, err := client.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+
+	// Allow the slow requests to reach the handler.
+	time.Sleep(probeThreshold)
+
+	for probeCount := 1; probeCount <= concurrentRequests; probeCount++ {
+		req, _ := http.NewRequest("HEAD", url, nil)
+
+		resp, duration := RoundTripTimed(t, req)
+		resp.Body.Close()
+
+		if duration > probeThreshold {
+			t.Errorf("Probe %d was delayed by slow requests, took %s", probeCount, duration)
+		}
+		if resp.Header.Get("PING") != "PONG" {
+			t.Errorf("Probe %d served incorrectly", probeCount)
+		}
+	}
+}
+
+// RoundTripTimed should return the time taken to receive a response, which
+// can't be less than the backend's ResponseDelay.
+func TestHelpersRoundTripTimed(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const responseDelay = time.Duration(200 * time.Millisecond)
+
+	originServer.ResponseDelay = responseDelay
+	url := originServer.server.URL + "/" + NewUUID()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, duration := RoundTripTimed(t, req)
+	defer resp.Body.Close()
+
+	if duration < responseDelay || duration > requestSlowThreshold {
+		t.Errorf(
+			"Incorrect duration for request. Expected between %s and %s, got %s",
+			responseDelay,
+			requestSlowThreshold,
+			duration,
+		)
+	}
+}
+
+// disableClientCompression should stop the transport from asking for gzip
+// until the function that it returns is called.
+func TestHelpersDisableClientCompression(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	var receivedAcceptEncoding string
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		receivedAcceptEncoding = r.Header.Get("Accept-Encoding")
+	})
+
+	url := originServer.server.URL + "/" + NewUUID()
+	restoreCompression := disableClientCompression()
+
+	for _, expectedAcceptEncoding := range []string{"", "gzip"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		resp := RoundTripCheckError(t, req)
+		resp.Body.Close()
+
+		if receivedAcceptEncoding != expectedAcceptEncoding {
+			t.Errorf(
+				"Request sent incorrect Accept-Encoding. Expected %q, got %q",
+				expectedAcceptEncoding,
+				receivedAcceptEncoding,
+			)
+		}
+
+		restoreCompression()
+	}
+}
+
+// CDNBackendServer should count the requests received for each path,
+// excluding `HEAD` health checks, until the handler is reset.
+func TestHelpersCDNBackendServerRequestCountForPath(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedCount = 3
+	path := "/" + NewUUID()
+	url := originServer.server.URL + path
+
+	for _, method := range []string{"GET", "HEAD", "GET", "POST"} {
+		req, _ := http.NewRequest(method, url, nil)
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+	}
+
+	if count := originServer.RequestCountForPath(path); count != expectedCount {
+		t.Errorf("Incorrect request count for %q. Expected %d, got %d", path, expectedCount, count)
+	}
+	if count := originServer.RequestCountForPath("/" + NewUUID()); count != 0 {
+		t.Errorf("Incorrect request count for unrequested path. Expected 0, got %d", count)
+	}
+
+	originServer.ResetHandler()
+	if count := originServer.RequestCountForPath(path); count != 0 {
+		t.Errorf("Request count not reset by ResetHandler. Expected 0, got %d", count)
+	}
+}
+
+// CDNBackendServer should record requests, excluding `HEAD` health checks,
+// and the responses to them in its transcript when Record is set, until the
+// handler is reset.
+func TestHelpersCDNBackendServerTranscript(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const reqBody = "sent to origin"
+	const respBody = "sent by origin"
+	const headerName = "Transcript-Test"
+	path := "/" + NewUUID()
+	url := originServer.server.URL + path
+
+	originServer.Record = true
+	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerName, r.Method)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(respBody))
+	})
+
+	for _, method := range []string{"GET", "HEAD", "POST"} {
+		var body io.Reader
+		if method == "POST" {
+			body = strings.NewReader(reqBody)
+		}
+
+		req, _ := http.NewRequest(method, url, body)
+		req.Header.Set(headerName, method)
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+	}
+
+	transcript := originServer.Transcript()
+	if count := len(transcript); count != 2 {
+		t.Fatalf("Incorrect number of exchanges in transcript. Expected 2, got %d", count)
+	}
+
+	for count, method := range []string{"GET", "POST"} {
+		exchange := transcript[count]
+		expectedReqBody := ""
+		if method == "POST" {
+			expectedReqBody = reqBody
+		}
+
+		if exchange.Method != method || exchange.URL != path {
+			t.Errorf(
+				"Exchange %d has incorrect request. Expected %s %q, got %s %q",
+				count+1,
+				method,
+				path,
+				exchange.Method,
+				exchange.URL,
+			)
+		}
+		if val := exchange.RequestHeader.Get(headerName); val != method {
+			t.Errorf("Exchange %d has incorrect request header. Expected %q, got %q", count+1, method, val)
+		}
+		if val := string(exchange.RequestBody); val != expectedReqBody {
+			t.Errorf("Exchange %d has incorrect request body. Expected %q, got %q", count+1, expectedReqBody, val)
+		}
+		if exchange.StatusCode != http.StatusCreated {
+			t.Errorf("Exchange %d has incorrect status code. Expected %d, got %d", count+1, http.StatusCreated, exchange.StatusCode)
+		}
+		if val := exchange.ResponseHeader.Get(headerName); val != method {
+			t.Errorf("Exchange %d has incorrect response header. Expected %q, got %q", count+1, method, val)
+		}
+		if val := string(exchange.ResponseBody); val != respBody {
+			t.Errorf("Exchange %d has incorrect response body. Expected %q, got %q", count+1, respBody, val)
+		}
+	}
+
+	originServer.ResetHandler()
+	if count := len(originServer.Transcript()); count != 0 {
+		t.Errorf("Transcript not reset by ResetHandler. Expected 0 exchanges, got %d", count)
+	}
+	if originServer.Record {
+		t.Error("Record not reset by ResetHandler")
+	}
+}
+
+// CDNBackendServer should mark exchanges in its transcript where the handler
+// hijacked the connection, rather than recording them as a 200 response.
+func TestHelpersCDNBackendServerTranscriptHijacked(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const rawResp = "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nraw"
+
+	originServer.Record = true
+	originServer.SwitchHandler(rawResponseHandler(t, []byte(rawResp)))
+
+	url := originServer.server.URL + "/" + NewUUID()
+	req, _ := http.NewRequest("GET", url, nil)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	transcript := originServer.Transcript()
+	if count := len(transcript); count != 1 {
+		t.Fatalf("Incorrect number of exchanges in transcript. Expected 1, got %d", count)
+	}
+
+	exchange := transcript[0]
+	if !exchange.Hijacked {
+		t.Error("Exchange for hijacked connection not marked as Hijacked")
+	}
+	if exchange.StatusCode != 0 {
+		t.Errorf("Exchange for hijacked connection has incorrect status code. Expected 0, got %d", exchange.StatusCode)
+	}
+}
+
+// CDNBackendServer should record the ALPN protocol negotiated for the most
+// recent request, excluding `HEAD` health checks, until the handler is reset.
+func TestHelpersCDNBackendServerLastNegotiatedProtocol(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedProtocol = "http/1.1"
+	url := originServer.server.URL + "/" + NewUUID()
+
+	// Offer h2 as well, which the server should decline.
+	tlsClient := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", expectedProtocol},
+		},
+	}
+	defer tlsClient.CloseIdleConnections()
+
+	req, _ := http.NewRequest("GET", url, nil)
+	resp, err := tlsClient.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// A health check without ALPN shouldn't replace it.
+	probeClient := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	defer probeClient.CloseIdleConnections()
+
+	req, _ = http.NewRequest("HEAD", url, nil)
+	resp, err = probeClient.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if protocol := originServer.LastNegotiatedProtocol(); protocol != expectedProtocol {
+		t.Errorf("Incorrect negotiated protocol. Expected %q, got %q", expectedProtocol, protocol)
+	}
+
+	originServer.ResetHandler()
+	if protocol := originServer.LastNegotiatedProtocol(); protocol != "" {
+		t.Errorf("Negotiated protocol not reset by ResetHandler. Expected %q, got %q", "", protocol)
+	}
+}
+
+// CDNBackendServer should serve files from a fixture directory with a
+// `Content-Type` according to their extension, and 404 responses for files
+// that don't exist.
+func TestHelpersCDNBackendServerServeFixtures(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const fixtureDir = "fixtures"
+	const fixtureName = "golang.css"
+	const expectedContentType = "text/css; charset=utf-8"
+
+	fixtureData, err := ioutil.ReadFile(filepath.Join(fixtureDir, fixtureName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originServer.ServeFixtures(fixtureDir)
+
+	url := originServer.server.URL + "/" + fixtureName
+	req, _ := http.NewRequest("GET", url, nil)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Fixture request received incorrect status %q", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != expectedContentType {
+		t.Errorf(
+			"Fixture request received incorrect Content-Type. Expected %q, got %q",
+			expectedContentType,
+			contentType,
+		)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, fixtureData) {
+		t.Error("Fixture request received body that did not match fixture")
+	}
+
+	url = originServer.server.URL + "/" + NewUUID()
+	req, _ = http.NewRequest("GET", url, nil)
+	resp = RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Missing fixture request received incorrect status %q", resp.Status)
+	}
+}
+
+// abortAfterHandler should send only part of the body that it declares in
+// `Content-Length` before closing the connection, so that clients see an
+// incomplete response.
+func TestHelpersAbortAfterHandler(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const body = "only some of this body is sent"
+	const cutAt = 9
+
+	originServer.SwitchHandler(abortAfterHandler([]byte(body), cutAt))
+
+	url := originServer.server.URL + "/" + NewUUID()
+	req, _ := http.NewRequest("GET", url, nil)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if resp.ContentLength != int64(len(body)) {
+		t.Errorf(
+			"Response received incorrect Content-Length. Expected %d, got %d",
+			len(body),
+			resp.ContentLength,
+		)
+	}
+
+	received, err := ioutil.ReadAll(resp.Body)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Reading response body returned incorrect error. Expected %q, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if string(received) != body[:cutAt] {
+		t.Errorf(
+			"Response received incorrect partial body. Expected %q, got %q",
+			body[:cutAt],
+			string(received),
+		)
+	}
+}
+
+// rawResponseHandler should send the bytes that it is given in place of a
+// response, even when they don't match the headers that they contain.
+func TestHelpersRawResponseHandler(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const declaredBody = "short"
+	const rawResp = "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nRaw-Header: sent\r\n\r\n" + declaredBody + " and extra"
+
+	originServer.SwitchHandler(rawResponseHandler(t, []byte(rawResp)))
+
+	url := originServer.server.URL + "/" + NewUUID()
+	req, _ := http.NewRequest("GET", url, nil)
+	resp := RoundTripCheckError(t, req)
+	defer resp.Body.Close()
+
+	if headerVal := resp.Header.Get("Raw-Header"); headerVal != "sent" {
+		t.Errorf("Response received incorrect Raw-Header. Expected %q, got %q", "sent", headerVal)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != declaredBody {
+		t.Errorf(
+			"Response received incorrect body. Expected %q, got %q",
+			declaredBody,
+			string(body),
+		)
+	}
+}
+
+// rawResponseKeepOpenHandler should leave the connection open after sending
+// its bytes, so that any beyond the first response are read as the response
+// to the next request on the same connection.
+func TestHelpersRawResponseKeepOpenHandler(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const secondBody = "second"
+	const rawResp = "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nfirst" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\n" + secondBody
+	const rawReq = "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+
+	originServer.SwitchHandler(rawResponseKeepOpenHandler(t, []byte(rawResp)))
+
+	conn, err := tls.Dial("tcp", originServer.server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+	connReader := bufio.NewReader(conn)
+
+	for requestCount := 1; requestCount <= 2; requestCount++ {
+		if _, err := io.WriteString(conn, rawReq); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.ReadResponse(connReader, nil)
+		if err != nil {
+			t.Fatalf("Request %d on the same connection failed: %s", requestCount, err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if requestCount == 2 && string(body) != secondBody {
+			t.Errorf(
+				"Request %d received incorrect body. Expected %q, got %q",
+				requestCount,
+				secondBody,
+				string(body),
+			)
+		}
+	}
+}
+
+// clientIPHandler should serve the client's address from `True-Client-IP`,
+// or the last address in `X-Forwarded-For` when that isn't present.
+func TestHelpersClientIPHandler(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	originServer.SwitchHandler(clientIPHandler())
+	url := originServer.server.URL + "/"
+
+	testCases := []struct {
+		trueClientIP  string
+		xForwardedFor string
+		expectedBody  string
+	}{
+		{"203.0.113.1", "198.51.100.1", "203.0.113.1"},
+		{"", "198.51.100.1, 198.51.100.2", "198.51.100.2"},
+		{"", "", ""},
+	}
+
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest("GET", url+NewUUID(), nil)
+		if testCase.trueClientIP != "" {
+			req.Header.Set("True-Client-IP", testCase.trueClientIP)
+		}
+		if testCase.xForwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", testCase.xForwardedFor)
+		}
+
+		resp := RoundTripCheckError(t, req)
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bodyStr := string(body); bodyStr != testCase.expectedBody {
+			t.Errorf(
+				"Incorrect body for True-Client-IP %q and X-Forwarded-For %q. Expected %q, got %q",
+				testCase.trueClientIP,
+				testCase.xForwardedFor,
+				testCase.expectedBody,
+				bodyStr,
+			)
+		}
+	}
+}
+
 func TestHelpersCDNServeStop(t *testing.T) {
 	ResetBackends(backendsByPriority)
 
@@ -261,6 +769,300 @@ func TestHelpersCDNBackendServerTLSCustomCert(t *testing.T) {
 	}
 }
 
+// CachedHostLookup should only resolve `Host` once and then always connect
+// to the first address returned, even if subsequent lookups would have
+// returned addresses in a different order, so that the tests don't switch
+// edge locations in the middle of a run.
+func TestHelpersCachedHostLookupPinsIP(t *testing.T) {
+	const host = "cdn-acceptance-tests.example.com"
+	const expectedIP = "127.0.0.1"
+	const dialCount = 5
+	lookupResults := [][]string{
+		{expectedIP, "127.0.0.2"},
+		{"127.0.0.2", expectedIP},
+	}
+	lookupCount := 0
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(expectedIP, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	c := CachedHostLookup{
+		Host: host,
+		lookupHost: func(ctx context.Context, host string) ([]string, error) {
+			result := lookupResults[lookupCount%len(lookupResults)]
+			lookupCount++
+			return result, nil
+		},
+	}
+
+	for count := 1; count <= dialCount; count++ {
+		conn, err := c.Dial("tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatalf("Dial %d failed: %s", count, err)
+		}
+
+		if ip := conn.RemoteAddr().(*net.TCPAddr).IP.String(); ip != expectedIP {
+			t.Errorf("Dial %d connected to wrong IP. Expected %q, got %q", count, expectedIP, ip)
+		}
+		conn.Close()
+	}
+
+	if lookupCount != 1 {
+		t.Errorf("Incorrect number of DNS lookups. Expected 1, got %d", lookupCount)
+	}
+}
+
+// CachedHostLookup should be safe to dial from multiple goroutines at once,
+// as http.Transport does, performing a single DNS lookup and connecting to
+// the same address every time. Run with -race to detect unsafe access.
+func TestHelpersCachedHostLookupConcurrentDials(t *testing.T) {
+	const host = "cdn-acceptance-tests.example.com"
+	const expectedIP = "127.0.0.1"
+	const concurrentDials = 10
+	var lookupCount int32
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(expectedIP, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	c := CachedHostLookup{
+		Host: host,
+		lookupHost: func(ctx context.Context, host string) ([]string, error) {
+			atomic.AddInt32(&lookupCount, 1)
+			// Widen the window in which concurrent dials could race.
+			time.Sleep(10 * time.Millisecond)
+			return []string{expectedIP}, nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentDials)
+
+	for i := 0; i < concurrentDials; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			conn, err := c.Dial("tcp", net.JoinHostPort(host, port))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			if ip := conn.RemoteAddr().(*net.TCPAddr).IP.String(); ip != expectedIP {
+				errs <- fmt.Errorf("connected to wrong IP. Expected %q, got %q", expectedIP, ip)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if count := atomic.LoadInt32(&lookupCount); count != 1 {
+		t.Errorf("Incorrect number of DNS lookups. Expected 1, got %d", count)
+	}
+}
+
+// NewCachedDialHosts should use a separate cached lookup for each host, and
+// dial any other host without looking it up in the cache.
+func TestHelpersNewCachedDialHosts(t *testing.T) {
+	const expectedIP = "127.0.0.1"
+	hosts := []string{
+		"cdn-acceptance-tests.example.com",
+		"cdn-acceptance-tests-2.example.com",
+	}
+	lookupCounts := make([]int32, len(hosts))
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(expectedIP, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var lookups []*CachedHostLookup
+	for i, host := range hosts {
+		lookups = append(lookups, &CachedHostLookup{
+			Host: host,
+			lookupHost: func(ctx context.Context, host string) ([]string, error) {
+				atomic.AddInt32(&lookupCounts[i], 1)
+				return []string{expectedIP}, nil
+			},
+		})
+	}
+	dial := NewCachedDialHosts(lookups...)
+
+	for _, host := range append(hosts, hosts[0], expectedIP) {
+		conn, err := dial(context.Background(), "tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			t.Fatalf("Dial to %q failed: %s", host, err)
+		}
+		conn.Close()
+	}
+
+	expectedCounts := []int32{1, 1}
+	if !reflect.DeepEqual(lookupCounts, expectedCounts) {
+		t.Errorf("Incorrect number of DNS lookups per host. Expected %v, got %v", expectedCounts, lookupCounts)
+	}
+}
+
+// LatencyRecorder should report nearest-rank percentiles of the durations
+// recorded, which may be recorded from multiple goroutines at once. Run with
+// -race to detect unsafe access.
+func TestHelpersLatencyRecorderPercentile(t *testing.T) {
+	const recordCount = 100
+	expectedPercentiles := map[float64]time.Duration{
+		0:   1 * time.Millisecond,
+		50:  50 * time.Millisecond,
+		90:  90 * time.Millisecond,
+		99:  99 * time.Millisecond,
+		100: 100 * time.Millisecond,
+	}
+
+	var l LatencyRecorder
+	if p := l.Percentile(50); p != 0 {
+		t.Errorf("Empty recorder returned incorrect percentile. Expected 0, got %s", p)
+	}
+
+	var wg sync.WaitGroup
+	for i := recordCount; i > 0; i-- {
+		wg.Add(1)
+		go func(d time.Duration) {
+			defer wg.Done()
+			l.Record(d)
+		}(time.Duration(i) * time.Millisecond)
+	}
+	wg.Wait()
+
+	if count := l.Count(); count != recordCount {
+		t.Errorf("Recorder returned incorrect count. Expected %d, got %d", recordCount, count)
+	}
+
+	for percentile, expected := range expectedPercentiles {
+		if received := l.Percentile(percentile); received != expected {
+			t.Errorf(
+				"Recorder returned incorrect p%.0f. Expected %s, got %s",
+				percentile,
+				expected,
+				received,
+			)
+		}
+	}
+}
+
+// firstDifference should find the offset of the first differing byte,
+// including where one body is a truncated or extended copy of the other.
+func TestHelpersFirstDifference(t *testing.T) {
+	const body = "<html>body</html>"
+	testCases := []struct {
+		got      string
+		expected int
+	}{
+		{body, -1},
+		{"\ufeff" + body, 0},
+		{"<html>Body</html>", 6},
+		{body + "\n", len(body)},
+		{body[:8], 8},
+	}
+
+	for _, testCase := range testCases {
+		if offset := firstDifference([]byte(testCase.got), []byte(body)); offset != testCase.expected {
+			t.Errorf(
+				"Incorrect offset for %q. Expected %d, got %d",
+				testCase.got,
+				testCase.expected,
+				offset,
+			)
+		}
+	}
+}
+
+// seededReader should produce the same sequence of bytes for the same seed,
+// and concurrent readers should continue the sequence rather than repeat
+// it. Run with -race to detect unsafe access.
+func TestHelpersSeededReader(t *testing.T) {
+	const seed = 42
+	const readCount = 50
+	const readSize = 16
+
+	readAll := func(r *seededReader) map[string]bool {
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		seen := make(map[string]bool, readCount)
+
+		for i := 0; i < readCount; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				bs := make([]byte, readSize)
+				r.Read(bs)
+
+				mutex.Lock()
+				seen[string(bs)] = true
+				mutex.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		return seen
+	}
+
+	first := readAll(newSeededReader(seed))
+	second := readAll(newSeededReader(seed))
+
+	if count := len(first); count != readCount {
+		t.Errorf("Concurrent reads returned repeated values. Expected %d unique, got %d", readCount, count)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Error("Readers with the same seed returned different sequences")
+	}
+}
+
 // generated from src/pkg/crypto/tls:
 // go run generate_cert.go --rsa-bits 512 --host 203.0.113.10,cdn-acceptance-tests.example.com --ca --start-date "Jan 1 00:00:00 1970" --duration=1000000h
 var customCert = []byte(`-----BEGIN CERTIFICATE-----
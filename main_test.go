@@ -1,29 +1,56 @@
 package main
 
 import (
+	"crypto/rand"
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"testing"
 	"time"
 )
 
 var (
-	backendCert   = flag.String("backendCert", "", "Override self-signed cert for backend TLS")
-	backendKey    = flag.String("backendKey", "", "Override self-signed cert, must be provided with -backendCert")
-	backupPort1   = flag.Int("backupPort1", 8081, "Backup1 port to listen on for requests")
-	backupPort2   = flag.Int("backupPort2", 8082, "Backup2 port to listen on for requests")
-	edgeHost      = flag.String("edgeHost", "", "Hostname of edge")
-	originPort    = flag.Int("originPort", 8080, "Origin port to listen on for requests")
-	skipFailover  = flag.Bool("skipFailover", false, "Skip failover tests and only setup the origin backend")
-	skipVerifyTLS = flag.Bool("skipVerifyTLS", false, "Skip TLS cert verification if set")
-	usage         = flag.Bool("usage", false, "Print usage")
-	vendor        = flag.String("vendor", "", "Name of vendor; run tests specific to vendor")
+	backendCert            = flag.String("backendCert", "", "Override self-signed cert for backend TLS")
+	backendConvergeRetries = flag.Int("backendConvergeRetries", 1, "Number of times to restart a backend that the edge doesn't consider healthy before aborting")
+	backendKey             = flag.String("backendKey", "", "Override self-signed cert, must be provided with -backendCert")
+	backupPort1            = flag.Int("backupPort1", 8081, "Backup1 port to listen on for requests")
+	backupPort2            = flag.Int("backupPort2", 8082, "Backup2 port to listen on for requests")
+	dateTolerance          = flag.Duration("dateTolerance", 5*time.Second, "Allowed clock skew between edge Date headers and ours")
+	edgeHost               = flag.String("edgeHost", "", "Hostname of edge")
+	edgeHost2              = flag.String("edgeHost2", "", "Hostname of a second edge service, with its own cache, for cross-host tests")
+	edgeIP                 = flag.String("edgeIP", "", "IP address of edge to connect to, instead of resolving -edgeHost")
+	forceIPv6              = flag.Bool("forceIPv6", false, "Connect to edge over IPv6 only")
+	hitLatencyRatio        = flag.Float64("hitLatencyRatio", 0.5, "Maximum duration of a cache hit as a fraction of the cache miss that preceded it")
+	latencyReport          = flag.Bool("latencyReport", false, "Report p50, p90 and p99 latencies of requests at the end of the run")
+	longHeaders            = flag.Int("longHeaders", 8192, "Total size in bytes of request headers for the long headers test")
+	longURL                = flag.Int("longURL", 8192, "Size in bytes of request URL for the long URL test")
+	negativeCache5xx       = flag.Duration("negativeCache5xx", 0, "Time for which edge is intentionally configured to cache 5xx responses; 0 if it doesn't")
+	originALPN             = flag.String("originALPN", "", "ALPN protocol that edge is expected to negotiate with backends, such as http/1.1; empty to skip the ALPN test")
+	originPort             = flag.Int("originPort", 8080, "Origin port to listen on for requests")
+	originTimeout          = flag.Duration("originTimeout", 0, "First byte timeout that edge is configured with for backends; 0 to skip the slow origin test")
+	purgeBound             = flag.Duration("purgeBound", 10*time.Second, "Maximum time for a purge to take effect at edge")
+	purgeWhitelisted       = flag.Bool("purgeWhitelisted", false, "Set if running from an address that edge allows to send PURGE requests")
+	repeatBackOff          = flag.Int("repeatBackOff", 1, "Number of times to run TestFailoverOrigin5xxBackOff, to reproduce intermittent failures")
+	seed                   = flag.Int64("seed", 0, "Seed for generating reproducible unique URLs; 0 to use crypto random")
+	skipFailover           = flag.Bool("skipFailover", false, "Skip failover tests and only setup the origin backend")
+	skipVerifyTLS          = flag.Bool("skipVerifyTLS", false, "Skip TLS cert verification if set")
+	slashPolicy            = flag.String("slashPolicy", "preserve", "Expected handling of repeated slashes in request paths; 'preserve' or 'collapse'")
+	slowOrigin             = flag.String("slowOrigin", "504", "Expected handling of origins slower than -originTimeout; '504' or 'failover'")
+	staleCacheStatus       = flag.Bool("staleCacheStatus", false, "Set if edge reports stale objects with a distinct cache status, such as STALE or HIT-STALE")
+	traceTimings           = flag.Bool("traceTimings", false, "Log DNS, connect, TLS and first byte timings of requests that use RoundTripCheckError")
+	usage                  = flag.Bool("usage", false, "Print usage")
+	varyVariants           = flag.Int("varyVariants", 0, "Expected maximum number of Vary variants cached per URL by edge; 0 if unbounded")
+	vendor                 = flag.String("vendor", "", "Name of vendor; run tests specific to vendor")
+	xffPolicy              = flag.String("xffPolicy", "permissive", "Expected handling of invalid client X-Forwarded-For entries; 'permissive' or 'strict'")
 	// This only works with tests that use RoundTripCheckError(), that either
 	// are either failing or run with the -v flag.
 	debugResp = flag.Bool("debugResp", false, "Log responses for debugging")
+	// As above, this only works with tests that use RoundTripCheckError().
+	debugConnReuse = flag.Bool("debugConnReuse", false, "Log whether connections to edge are reused")
 )
 
 var (
@@ -39,14 +66,43 @@ const requestTimeout = time.Second * 5
 
 var (
 	client             *http.Transport
+	clientIPv4         *http.Transport
+	clientIPv6         *http.Transport
 	originServer       *CDNBackendServer
 	backupServer1      *CDNBackendServer
 	backupServer2      *CDNBackendServer
 	backendsByPriority []*CDNBackendServer
+	latencies          LatencyRecorder
+	uuidReader         io.Reader = rand.Reader
 )
 
-// Setup clients and servers.
-func init() {
+// newEdgeTransport returns a client transport with a cached DNS lookup for
+// edge, or the IP given by -edgeIP, and for -edgeHost2 if it is set. The
+// network, such as "tcp4" or "tcp6", may be empty to allow either.
+func newEdgeTransport(network string) *http.Transport {
+	tlsOptions := &tls.Config{}
+	if *skipVerifyTLS {
+		tlsOptions.InsecureSkipVerify = true
+	}
+
+	lookups := []*CachedHostLookup{
+		{Host: *edgeHost, Network: network, IP: *edgeIP},
+	}
+	if *edgeHost2 != "" {
+		lookups = append(lookups, &CachedHostLookup{Host: *edgeHost2, Network: network})
+	}
+
+	return &http.Transport{
+		ResponseHeaderTimeout: requestTimeout,
+		TLSClientConfig:       tlsOptions,
+		DialContext:           NewCachedDialHosts(lookups...),
+	}
+}
+
+// Setup clients and servers. This must be called from TestMain, rather
+// than init(), so that flags for the testing package have been defined
+// before we parse them.
+func setup() {
 
 	flag.Parse()
 
@@ -72,15 +128,18 @@ func init() {
 		log.Fatalf("Vendor %q unrecognised; aborting", *vendor)
 	}
 
-	tlsOptions := &tls.Config{}
-	if *skipVerifyTLS {
-		tlsOptions.InsecureSkipVerify = true
+	if *seed != 0 {
+		log.Printf("Generating unique URLs from seed %d", *seed)
+		uuidReader = newSeededReader(*seed)
 	}
-	client = &http.Transport{
-		ResponseHeaderTimeout: requestTimeout,
-		TLSClientConfig:       tlsOptions,
-		Dial:                  NewCachedDial(*edgeHost),
+
+	var edgeNetwork string
+	if *forceIPv6 {
+		edgeNetwork = "tcp6"
 	}
+	client = newEdgeTransport(edgeNetwork)
+	clientIPv4 = newEdgeTransport("tcp4")
+	clientIPv6 = newEdgeTransport("tcp6")
 
 	var backendCerts []tls.Certificate
 	if *backendCert != "" || *backendKey != "" {
@@ -123,3 +182,23 @@ func init() {
 	log.Println("Confirming that CDN is healthy")
 	ResetBackends(backendsByPriority)
 }
+
+// Setup, run the tests, and then stop the backends and report request
+// latencies, if enabled.
+func TestMain(m *testing.M) {
+	setup()
+	code := m.Run()
+	stopBackends(backendsByPriority)
+
+	if *latencyReport {
+		log.Printf(
+			"Latency of %d requests: p50 %s, p90 %s, p99 %s",
+			latencies.Count(),
+			latencies.Percentile(50),
+			latencies.Percentile(90),
+			latencies.Percentile(99),
+		)
+	}
+
+	os.Exit(code)
+}